@@ -1,256 +1,4398 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 	blackfriday "gopkg.in/russross/blackfriday.v2"
+	"gopkg.in/yaml.v3"
 )
 
+type HenryConfig struct {
+	Author               string                 `toml:"author"`
+	BaseURL              string                 `toml:"baseURL"`
+	BuildDrafts          bool                   `toml:"buildDrafts"`
+	ContentDir           string                 `toml:"contentDir"`
+	ContentDirs          []string               `toml:"contentDirs"`
+	DataDir              string                 `toml:"dataDir"`
+	Description          string                 `toml:"description"`
+	DirMode              string                 `toml:"dirMode"`
+	DocumentCache        HenryDocumentCache     `toml:"-"`
+	DraftBanner          bool                   `toml:"-"`
+	Environment          string                 `toml:"environment"`
+	ExcludeParams        []string               `toml:"excludeParams"`
+	FileMode             string                 `toml:"fileMode"`
+	FilenameDate         string                 `toml:"filenameDate"`
+	FilenameDatePattern  *regexp.Regexp         `toml:"-"`
+	FingerprintURLs      bool                   `toml:"fingerprintURLs"`
+	FrontmatterDelimiter string                 `toml:"frontmatterDelimiter"`
+	Generators           []HenryGenerator       `toml:"generators"`
+	GitInfo              bool                   `toml:"gitInfo"`
+	HeadingAnchors       bool                   `toml:"headingAnchors"`
+	HeadingOffset        int                    `toml:"headingOffset"`
+	JSONFeed             bool                   `toml:"jsonFeed"`
+	Jobs                 int                    `toml:"jobs"`
+	LazyImages           bool                   `toml:"lazyImages"`
+	Language             string                 `toml:"language"`
+	Math                 bool                   `toml:"math"`
+	Manifest             string                 `toml:"manifest"`
+	MaxFileSize          int64                  `toml:"maxFileSize"`
+	MaxYearsAhead        int                    `toml:"maxYearsAhead"`
+	MinYear              int                    `toml:"minYear"`
+	NormalizeHTML        bool                   `toml:"normalizeHTML"`
+	Markdown             HenryMarkdownConfig    `toml:"markdown"`
+	OutputDir            string                 `toml:"outputDir"`
+	OutputFormat         string                 `toml:"outputFormat"`
+	OutputLog            *HenryOutputLog        `toml:"-"`
+	Params               map[string]interface{} `toml:"params"`
+	PostBuild            string                 `toml:"postBuild"`
+	PreBuild             string                 `toml:"preBuild"`
+	Pretty               bool                   `toml:"pretty"`
+	PrettyURLs           bool                   `toml:"prettyURLs"`
+	ProtectCode          bool                   `toml:"protectCode"`
+	PublishIncludes      bool                   `toml:"publishIncludes"`
+	ProgressThreshold    int                    `toml:"progressThreshold"`
+	Quiet                bool                   `toml:"-"`
+	RecentCount          int                    `toml:"recentCount"`
+	RedirectPages        bool                   `toml:"redirectPages"`
+	RedirectsFile        string                 `toml:"redirectsFile"`
+	Remote               []HenryRemoteSource    `toml:"remote"`
+	Since                time.Time              `toml:"-"`
+	SkipEmpty            bool                   `toml:"skipEmpty"`
+	Slug                 HenrySlugConfig        `toml:"slug"`
+	Smartypants          bool                   `toml:"smartypants"`
+	SortKey              string                 `toml:"sortKey"`
+	Sitemap              bool                   `toml:"sitemap"`
+	SitemapLimit         int                    `toml:"sitemapLimit"`
+	StaticDir            string                 `toml:"staticDir"`
+	Strict               bool                   `toml:"strict"`
+	StripTitleHeading    bool                   `toml:"stripTitleHeading"`
+	SummaryFormat        string                 `toml:"summaryFormat"`
+	TagFeeds             bool                   `toml:"tagFeeds"`
+	TemplateDir          string                 `toml:"templateDir"`
+	Timings              *HenryTimings          `toml:"-"`
+	Title                string                 `toml:"title"`
+	TitleFromHeading     bool                   `toml:"titleFromHeading"`
+	TOCMarker            string                 `toml:"tocMarker"`
+	Transform            []string               `toml:"transform"`
+	TrailingSlash        string                 `toml:"trailingSlash"`
+	Types                map[string]string      `toml:"types"`
+	UglyURLs             bool                   `toml:"uglyURLs"`
+}
+
 type HenryFile struct {
 	Name        string
+	OutputName  string
 	Path        string
+	Root        string
 	SubPath     string
 	Type        HenryFileType
+	Draft       bool
+	NotFound    bool
+	IsSection   bool
+	IsBundle    bool
+	Skipped     bool
 	Data        []byte
 	Body        string
 	HasMetadata bool
 	Metadata    *HenryFileMetadata
 	Date        time.Time
+	NameDate    time.Time
+	GitInfo     *HenryGitInfo
 }
 
 type HenryFileMetadata struct {
-	Title   string    `toml:"title"`
-	Date    time.Time `toml:"date"`
-	Draft   bool      `toml:"draft"`
-	Summary string    `toml:"summary"`
+	Title         string                 `toml:"title" yaml:"title"`
+	Author        string                 `toml:"author" yaml:"author"`
+	Date          time.Time              `toml:"date" yaml:"date"`
+	Description   string                 `toml:"description" yaml:"description"`
+	Draft         bool                   `toml:"draft" yaml:"draft"`
+	Environments  []string               `toml:"environments" yaml:"environments"`
+	Exclude       []string               `toml:"exclude" yaml:"exclude"`
+	HeadingOffset int                    `toml:"headingOffset" yaml:"headingOffset"`
+	Include       []string               `toml:"include" yaml:"include"`
+	Lang          string                 `toml:"lang" yaml:"lang"`
+	LastMod       time.Time              `toml:"lastmod" yaml:"lastmod"`
+	NoIndex       bool                   `toml:"noindex" yaml:"noindex"`
+	OutputPath    string                 `toml:"outputPath" yaml:"outputPath"`
+	Outputs       []string               `toml:"outputs" yaml:"outputs"`
+	Private       bool                   `toml:"private" yaml:"private"`
+	Params        map[string]interface{} `toml:"params" yaml:"params"`
+	Summary       string                 `toml:"summary" yaml:"summary"`
+	Tags          []string               `toml:"tags" yaml:"tags"`
+	Teaser        string                 `toml:"teaser" yaml:"teaser"`
 }
 
 type HenryDocument struct {
+	ID                string
+	Name              string
+	SubPath           string
+	Path              string
+	URL               string
+	LinkURL           string
+	Hash              string
 	Title             string
+	Author            string
+	Lang              string
 	Content           string
 	ContentRaw        string
 	ContentParagraphs []string
 	Date              time.Time
+	Description       string
+	MetaDescription   string
+	LastMod           time.Time
+	GitInfo           *HenryGitInfo
+	ModTime           time.Time
+	Source            string
 	Draft             bool
+	NoIndex           bool
+	IsSection         bool
+	Resources         []*HenryResource
+	Outputs           []string
+	Exclude           []string
+	Params            map[string]interface{}
 	Summary           string
 	SummaryRaw        string
+	SummaryText       string
+	Tags              []string
+	Teaser            string
+}
+
+type HenryDocumentCache map[string]*HenryDocument
+
+type HenryGitInfo struct {
+	Hash            string
+	AbbreviatedHash string
+	Date            time.Time
+}
+
+type HenryJSONLDArticle struct {
+	Context       string             `json:"@context"`
+	Type          string             `json:"@type"`
+	Headline      string             `json:"headline"`
+	DatePublished string             `json:"datePublished"`
+	DateModified  string             `json:"dateModified"`
+	Author        *HenryJSONLDPerson `json:"author,omitempty"`
+	Description   string             `json:"description,omitempty"`
+}
+
+type HenryJSONLDPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type HenryRedirect struct {
+	From   string `toml:"from"`
+	To     string `toml:"to"`
+	Status int    `toml:"status"`
+}
+
+type HenryRedirectTable struct {
+	Redirects []HenryRedirect `toml:"redirect"`
+}
+
+type HenryGenerator struct {
+	Template string `toml:"template"`
+	Data     string `toml:"data"`
+	Path     string `toml:"path"`
+}
+
+type HenryGeneratorData struct {
+	Site   *HenrySite
+	Record map[string]interface{}
+}
+
+type HenryRemoteSource struct {
+	URL  string `toml:"url"`
+	Path string `toml:"path"`
+}
+
+type HenrySite struct {
+	Title       string
+	Description string
+	Author      string
+	BaseURL     string
+	Language    string
+	Data        map[string]interface{}
+	Params      map[string]interface{}
+	BuildTime   time.Time
+	Documents   []*HenryDocument
+	Recent      []*HenryDocument
+	Sections    map[string]*HenryDocument
+	Stats       *HenrySiteStats
+}
+
+type HenrySiteStats struct {
+	Published int
+	Drafts    int
+	Tags      map[string]int
+	Years     map[int]int
+}
+
+type HenryPathList []string
+
+type HenryMarkdownConfig struct {
+	Engine string `toml:"engine"`
+}
+
+type MarkdownRenderer interface {
+	Render(source []byte) []byte
+}
+
+type MetadataTransformer interface {
+	Transform(metadata *HenryFileMetadata)
+}
+
+type HenryLowercaseTags struct{}
+
+type HenryArchiveData struct {
+	Site  *HenrySite
+	Years []*HenryArchiveYear
+}
+
+type HenryArchiveMonth struct {
+	Month     time.Month
+	Documents []*HenryDocument
+}
+
+type HenryArchiveYear struct {
+	Year   int
+	Months []*HenryArchiveMonth
+}
+
+type HenryBlackfridayRenderer struct {
+	Smartypants bool
+}
+
+type HenryHTMLRenderer struct{}
+
+type HenryPlainRenderer struct{}
+
+type HenryGoldmarkRenderer struct {
+	Smartypants bool
+}
+
+type HenryOutputLog struct {
+	Paths []string
+	mu    sync.Mutex
+}
+
+type HenryManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type HenryPageData struct {
+	Site *HenrySite
+	Page *HenryDocument
+}
+
+type HenryProgress struct {
+	Out   io.Writer
+	Label string
+	Total int
+	Done  int
+	mu    sync.Mutex
+}
+
+type HenryTimings struct {
+	Phases    []string
+	Durations map[string]time.Duration
+	mu        sync.Mutex
+}
+
+type HenrySlugConfig struct {
+	Preserve      string            `toml:"preserve"`
+	Replace       map[string]string `toml:"replace"`
+	Transliterate map[string]string `toml:"transliterate"`
+}
+
+type HenryResource struct {
+	Name string
+	URL  string
+}
+
+type HenryTagEntry struct {
+	Title   string                 `json:"title"`
+	URL     string                 `json:"url"`
+	Date    string                 `json:"date"`
+	Summary string                 `json:"summary"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+type HenryTagIndex struct {
+	Name  string `json:"name"`
+	Slug  string `json:"slug"`
+	URL   string `json:"url"`
+	Feed  string `json:"feed,omitempty"`
+	Count int    `json:"count"`
+}
+
+type HenryRSS struct {
+	XMLName xml.Name        `xml:"rss"`
+	Version string          `xml:"version,attr"`
+	Channel HenryRSSChannel `xml:"channel"`
+}
+
+type HenryRSSChannel struct {
+	Title       string         `xml:"title"`
+	Link        string         `xml:"link"`
+	Description string         `xml:"description"`
+	Language    string         `xml:"language,omitempty"`
+	Items       []HenryRSSItem `xml:"item"`
+}
+
+type HenryRSSItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description,omitempty"`
+}
+
+type HenrySitemap struct {
+	XMLName xml.Name          `xml:"urlset"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	URLs    []HenrySitemapURL `xml:"url"`
+}
+
+type HenrySitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type HenrySitemapIndex struct {
+	XMLName  xml.Name            `xml:"sitemapindex"`
+	Xmlns    string              `xml:"xmlns,attr"`
+	Sitemaps []HenrySitemapEntry `xml:"sitemap"`
+}
+
+type HenrySitemapEntry struct {
+	Loc string `xml:"loc"`
+}
+
+type HenryJSONFeed struct {
+	Version     string              `json:"version"`
+	Title       string              `json:"title"`
+	HomePageURL string              `json:"home_page_url,omitempty"`
+	FeedURL     string              `json:"feed_url,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Language    string              `json:"language,omitempty"`
+	Items       []HenryJSONFeedItem `json:"items"`
+}
+
+type HenryJSONFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+type HenryDocumentJSON struct {
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	URL         string                 `json:"url"`
+	Author      string                 `json:"author,omitempty"`
+	Date        string                 `json:"date"`
+	LastMod     string                 `json:"lastmod"`
+	Description string                 `json:"description,omitempty"`
+	Summary     string                 `json:"summary"`
+	Tags        []string               `json:"tags,omitempty"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	Content     string                 `json:"content"`
 }
 
 type HenryFileType int
 
+type RenderOptions struct {
+	BasePath       string
+	DocumentDir    string
+	HeadingAnchors bool
+	HeadingOffset  int
+	ImageRoots     []string
+	LazyImages     bool
+	Math           bool
+	ProtectCode    bool
+	Policy         *bluemonday.Policy
+	Renderer       MarkdownRenderer
+	ResolveImages  bool
+	Slug           HenrySlugConfig
+}
+
+type HenryStrictError struct {
+	Err error
+}
+
+type HenryUsageError struct {
+	Err error
+}
+
+var henryBodyPattern = regexp.MustCompile(`(?i)<body\b[^>]*>`)
+
+const henryCacheFile = ".henry-cache.json"
+
+const henryDraftBanner = `<div class="henry-draft-banner" style="background:#c00;color:#fff;font:bold 14px sans-serif;padding:6px;text-align:center">DRAFT</div>`
+
+var henryCodePattern = regexp.MustCompile(`<pre><code(?: class="language-[\w+-]+")?>[^<]*</code></pre>|<code>[^<]*</code>`)
+
+//go:embed defaults/templates/*.html
+var henryDefaultTemplates embed.FS
+
+var henryBlockElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.Title: true, atom.Meta: true, atom.Link: true,
+	atom.Script: true, atom.Style: true, atom.Article: true, atom.Section: true, atom.Header: true,
+	atom.Footer: true, atom.Nav: true, atom.Main: true, atom.Aside: true, atom.Div: true, atom.P: true,
+	atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Pre: true, atom.Blockquote: true, atom.Figure: true, atom.Hr: true, atom.Table: true,
+	atom.Thead: true, atom.Tbody: true, atom.Tfoot: true, atom.Tr: true, atom.Th: true, atom.Td: true,
+}
+
+var henryLogger = log.New(os.Stderr, "", 0)
+
+var henryEnvPattern = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+var henryGeneratorField = regexp.MustCompile(`\{\w+\}`)
+
+var henryVoidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true, atom.Embed: true, atom.Hr: true,
+	atom.Img: true, atom.Input: true, atom.Link: true, atom.Meta: true, atom.Param: true,
+	atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+var henryOptionalEndElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.P: true, atom.Li: true, atom.Dt: true,
+	atom.Dd: true, atom.Option: true, atom.Optgroup: true, atom.Tr: true, atom.Td: true, atom.Th: true,
+	atom.Thead: true, atom.Tbody: true, atom.Tfoot: true, atom.Colgroup: true, atom.Caption: true,
+	atom.Rt: true, atom.Rp: true,
+}
+
+var henryHeadingPattern = regexp.MustCompile(`(?i)<(/?)h([1-6])\b`)
+
+var henryTemplateFuncs = template.FuncMap{
+	"jsonLD": func(doc *HenryDocument, site *HenrySite) (template.JS, error) {
+		data, err := doc.JSONLD(&HenryConfig{Author: site.Author})
+		return template.JS(data), err
+	},
+	"safeHTML": func(s string) template.HTML {
+		return template.HTML(s)
+	},
+}
+
 const (
 	HenryFileTypeUnknown HenryFileType = iota
 	HenryFileTypeMarkdown
+	HenryFileTypeHTML
+	HenryFileTypePlain
+	HenryFileTypeAsset
+	HenryFileTypeIgnore
 )
 
-func analyzeHenryFile(file *HenryFile, rootPath *string) error {
-	err := classifyHenryFile(file, rootPath)
+var henryMetadataTransformers = map[string]MetadataTransformer{
+	"lowercase-tags": &HenryLowercaseTags{},
+}
+
+var henryFileTypes = map[string]HenryFileType{
+	"markdown": HenryFileTypeMarkdown,
+	"html":     HenryFileTypeHTML,
+	"plain":    HenryFileTypePlain,
+	"asset":    HenryFileTypeAsset,
+	"ignore":   HenryFileTypeIgnore,
+}
+
+const (
+	HenryExitSuccess     = 0
+	HenryExitBuildError  = 1
+	HenryExitUsageError  = 2
+	HenryExitStrictError = 3
+)
+
+func analyzeHenryFile(file *HenryFile, rootPath *string, config *HenryConfig) error {
+	err := classifyHenryFile(file, rootPath, config)
+	if err != nil {
+		return err
+	}
+
+	if file.Type == HenryFileTypeIgnore {
+		file.Skipped = true
+		return nil
+	}
+
+	if isHenryDocumentFile(file) && config.FilenameDatePattern != nil {
+		if m := config.FilenameDatePattern.FindStringSubmatchIndex(file.Name); m != nil && m[0] == 0 && m[1] < len(file.Name) && m[2] >= 0 {
+			if date, err := parseHenryTime(file.Name[m[2]:m[3]]); err == nil {
+				file.NameDate = date
+				file.OutputName = file.Name[m[1]:]
+			}
+		}
+	}
+
+	info, err := os.Stat(file.Path)
 	if err != nil {
 		return err
 	}
+	file.Date = info.ModTime()
+
+	if isHenryDocumentFile(file) && config.MaxFileSize > 0 && info.Size() > config.MaxFileSize {
+		debug("warning: skipping %s: %s bytes exceeds maxFileSize of %s bytes", file.Path, strconv.FormatInt(info.Size(), 10), strconv.FormatInt(config.MaxFileSize, 10))
+		file.Skipped = true
+		return nil
+	}
 
-	if file.Type == HenryFileTypeMarkdown {
+	if isHenryDocumentFile(file) {
+		start := time.Now()
 		readErr := readHenryFileData(file)
 		if readErr != nil {
 			return readErr
 		}
+		config.Timings.Add("read", time.Since(start))
 
-		metaErr := readHenryFileMetadata(file)
+		start = time.Now()
+		metaErr := readHenryFileMetadata(file, config)
 		if metaErr != nil {
 			return metaErr
 		}
+		config.Timings.Add("frontmatter", time.Since(start))
 	}
 
-	info, err := os.Stat(file.Path)
-	if err != nil {
-		return err
+	if config.GitInfo && isHenryDocumentFile(file) {
+		file.GitInfo = readHenryGitInfo(file.Path)
 	}
-	file.Date = info.ModTime()
 
 	return nil
 }
 
-func classifyHenryFile(file *HenryFile, rootPath *string) error {
-	if strings.HasSuffix(file.Path, ".md") {
-		file.Type = HenryFileTypeMarkdown
-	} else {
-		file.Type = HenryFileTypeUnknown
+func anchorHenryHeadings(content string, config *HenryConfig) (string, error) {
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return "", err
 	}
 
-	var tmp string
-	tmp = strings.TrimPrefix(file.Path, *rootPath)
-	tmp = strings.TrimSuffix(tmp, file.Name)
-	file.SubPath = tmp
+	seen := make(map[string]int)
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch node.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				id := henryHeadingID(node, seen, config)
 
-	return nil
-}
+				anchor := &html.Node{Type: html.ElementNode, Data: "a", DataAtom: atom.A, Attr: []html.Attribute{
+					{Key: "href", Val: "#" + id},
+					{Key: "class", Val: "anchor"},
+				}}
+				anchor.AppendChild(&html.Node{Type: html.TextNode, Data: "#"})
+				node.AppendChild(&html.Node{Type: html.TextNode, Data: " "})
+				node.AppendChild(anchor)
+				return
+			}
+		}
 
-func createHenryDocument(file *HenryFile) (*HenryDocument, error) {
-	doc := &HenryDocument{}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
 
-	u := blackfriday.Run([]byte(file.Body))
-	h := string(bluemonday.UGCPolicy().SanitizeBytes(u))
-	content := strings.Replace(h, "\n\n", "\n", -1)
-	content = strings.Trim(content, "\n")
+	for _, node := range nodes {
+		walk(node)
+	}
 
-	doc.Content = content
-	doc.ContentRaw = file.Body
-	doc.ContentParagraphs = make([]string, 0)
-	for _, paragraph := range strings.SplitAfter(doc.Content, "\n") {
-		doc.ContentParagraphs = append(doc.ContentParagraphs, strings.Trim(paragraph, "\n"))
+	return renderHenryFragment(nodes)
+}
+
+func checkHenryDate(date time.Time, now time.Time, config *HenryConfig) error {
+	if config.MinYear > 0 && date.Year() < config.MinYear {
+		return errors.New(fmt.Sprintf("year %d is before minYear %d", date.Year(), config.MinYear))
 	}
 
-	if file.Metadata.Title != "" {
-		doc.Title = file.Metadata.Title
-	} else {
-		doc.Title = file.Name
+	if config.MaxYearsAhead > 0 && date.Year() > now.Year()+config.MaxYearsAhead {
+		return errors.New(fmt.Sprintf("year %d is more than %d years ahead", date.Year(), config.MaxYearsAhead))
 	}
 
-	if !file.Metadata.Date.IsZero() {
-		doc.Date = file.Metadata.Date
-	} else {
-		doc.Date = file.Date
+	return nil
+}
+
+func classifyHenryFile(file *HenryFile, rootPath *string, config *HenryConfig) error {
+	file.Type = HenryFileTypeUnknown
+	if strings.HasSuffix(file.Path, ".md") {
+		file.Type = HenryFileTypeMarkdown
+	}
+	for ext, kind := range config.Types {
+		if strings.EqualFold(filepath.Ext(file.Name), ext) {
+			file.Type = henryFileTypes[kind]
+		}
 	}
 
-	if file.Metadata.Draft {
-		doc.Draft = file.Metadata.Draft
-	} else {
-		doc.Draft = false
+	file.Root = filepath.Clean(*rootPath)
+	dir, err := filepath.Rel(file.Root, filepath.Dir(file.Path))
+	if err != nil {
+		return err
+	}
+	file.SubPath = string(filepath.Separator)
+	if dir != "." {
+		file.SubPath += dir + string(filepath.Separator)
 	}
 
-	if file.Metadata.Summary != "" {
-		su := blackfriday.Run([]byte(file.Metadata.Summary))
-		sh := string(bluemonday.UGCPolicy().SanitizeBytes(su))
-		doc.Summary = sh
-		doc.SummaryRaw = file.Metadata.Summary
-	} else {
-		if len(doc.ContentParagraphs) > 0 {
-			doc.Summary = doc.ContentParagraphs[0]
-		}
+	if file.Type == HenryFileTypeMarkdown && strings.Trim(filepath.ToSlash(file.SubPath), "/") == "" {
+		file.NotFound = file.Name == "404.md" || file.Name == "_404.md"
 	}
 
-	return doc, nil
-}
+	file.IsSection = file.Type == HenryFileTypeMarkdown && file.Name == "_index.md"
+	file.IsBundle = file.Type == HenryFileTypeMarkdown && file.Name == "index.md" && strings.Trim(filepath.ToSlash(file.SubPath), "/") != ""
 
-func createHenryDocuments(files []*HenryFile) ([]*HenryDocument, error) {
-	docs := make([]*HenryDocument, 0)
+	if isHenryDocumentFile(file) && strings.HasPrefix(file.Name, "_") && !file.IsSection && !file.NotFound {
+		file.Draft = true
+	}
+
+	return nil
+}
 
+func copyHenryContentAssets(files []*HenryFile, config *HenryConfig) error {
 	for _, file := range files {
-		doc, err := createHenryDocument(file)
-		if err != nil {
-			debug("%s", err.Error())
+		if file.Type != HenryFileTypeAsset {
 			continue
 		}
 
-		docs = append(docs, doc)
+		rel := henryAssetPath(file)
+		if err := copyHenryFile(file.Path, filepath.Join(config.OutputDir, filepath.FromSlash(rel)), config); err != nil {
+			return err
+		}
+		config.OutputLog.Record(rel)
 	}
 
-	return docs, nil
+	return nil
 }
 
-func debug(params ...string) {
-	args := make([]interface{}, len(params)-1)
-	for i := 1; i < len(params); i++ {
-		args[i-1] = params[i]
+func copyHenryFile(src string, dst string, config *HenryConfig) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
 
-	fmt.Printf(fmt.Sprintf("%s\n", params[0]), args...)
+	if err := os.MkdirAll(filepath.Dir(dst), henryDirMode(config)); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, henryFileMode(config))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, henryFileMode(config))
 }
 
-func findHenryFiles(rootPath string) ([]*HenryFile, error) {
-	foundFiles := make([]*HenryFile, 0)
+func copyHenryStaticFiles(config *HenryConfig) error {
+	if _, err := os.Stat(config.StaticDir); os.IsNotExist(err) {
+		return nil
+	}
 
-	err := filepath.Walk(rootPath, func(path string, file os.FileInfo, err error) error {
+	return filepath.Walk(config.StaticDir, func(path string, file os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !file.IsDir() {
-			henryFile := &HenryFile{Name: file.Name(), Path: path}
-			if err := analyzeHenryFile(henryFile, &rootPath); err == nil {
-				foundFiles = append(foundFiles, henryFile)
-			} else {
-				return err
-			}
+		if file.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(config.StaticDir, path)
+		if err != nil {
+			return err
 		}
+
+		if err := copyHenryFile(path, filepath.Join(config.OutputDir, rel), config); err != nil {
+			return err
+		}
+		config.OutputLog.Record(filepath.ToSlash(rel))
+
 		return nil
 	})
-
-	return foundFiles, err
 }
 
-func main() {
-	fmt.Printf("%s v.0.1\n", os.Args[0])
-
-	rootPath := "/home/claes/go/src/github.com/claesp/henry/data/"
-	henryFiles, err := findHenryFiles(rootPath)
-	if err != nil {
-		panic(err)
-	}
+func countHenryDocuments(docs []*HenryDocument, now time.Time, drafts bool) *HenrySiteStats {
+	stats := &HenrySiteStats{Tags: make(map[string]int), Years: make(map[int]int)}
 
-	henryDocs, err := createHenryDocuments(henryFiles)
-	if err != nil {
-		panic(err)
-	}
+	for _, doc := range docs {
+		if doc.Draft {
+			stats.Drafts++
+		}
 
-	for _, henryDoc := range henryDocs {
-		fmt.Println(henryDoc)
-	}
-}
+		if !isHenryDocumentIndexed(doc, now, drafts) {
+			continue
+		}
 
-func readHenryFileData(file *HenryFile) error {
-	fo, err := os.Open(file.Path)
-	if err != nil {
-		return err
+		stats.Published++
+		stats.Years[doc.Date.Year()]++
 	}
-	defer fo.Close()
 
-	data, err := ioutil.ReadAll(fo)
-	if err != nil {
-		return err
+	for tag, tagged := range groupHenryDocumentsByTag(filterHenryExcluded(docs, "tags"), now, drafts) {
+		stats.Tags[tag] = len(tagged)
 	}
 
-	file.Data = data
-
-	return nil
+	return stats
 }
 
-func readHenryFileMetadata(file *HenryFile) error {
-	var metadata HenryFileMetadata
+func createHenryDocument(file *HenryFile, config *HenryConfig) (*HenryDocument, error) {
+	doc := &HenryDocument{}
+	doc.ID = henryDocumentID(file)
+	doc.Name = file.Name
+	doc.SubPath = strings.Trim(filepath.ToSlash(file.SubPath), "/")
+	doc.Path = henryDocumentPath(file, config)
+	doc.URL = henryDocumentURL(doc, config)
 
-	if len(file.Data) == 0 {
-		return nil
+	headingOffset := config.HeadingOffset
+	if file.Metadata.HeadingOffset != 0 {
+		headingOffset = file.Metadata.HeadingOffset
 	}
 
-	file.HasMetadata = false
-	file.Metadata = &metadata
+	basePath := henryBasePath(config)
 
-	hdr := string(file.Data[0:3])
-	if hdr != "---" {
-		file.Body = string(file.Data)
-		return nil
+	body, err := expandHenryIncludes(file, config, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	headerParts := strings.Split(string(file.Data), "---")
-	if len(headerParts) < 3 {
-		return errors.New(fmt.Sprintf("error parsing metadata in '%s': missing closing tag", file.Name))
+	content, err := RenderMarkdown(body, RenderOptions{
+		BasePath:       basePath,
+		DocumentDir:    doc.SubPath,
+		HeadingAnchors: config.HeadingAnchors,
+		HeadingOffset:  headingOffset,
+		ImageRoots:     []string{file.Root, config.StaticDir},
+		LazyImages:     config.LazyImages,
+		Math:           config.Math,
+		ProtectCode:    config.ProtectCode,
+		Renderer:       henryDocumentRenderer(file, config),
+		ResolveImages:  true,
+		Slug:           config.Slug,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := toml.Decode(headerParts[1], &metadata); err != nil {
-		return errors.New(fmt.Sprintf("error parsing metadata in '%s': %s", file.Name, err))
+	if config.TOCMarker != "" {
+		content, err = insertHenryTOC(content, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	doc.Content = content
+	doc.ContentRaw = body
+
+	paragraphs, err := findHenryParagraphs(doc.Content)
+	if err != nil {
+		return nil, err
+	}
+	doc.ContentParagraphs = paragraphs
+
+	hash := sha256.Sum256([]byte(content))
+	doc.Hash = hex.EncodeToString(hash[:])[:12]
+	doc.LinkURL = doc.URL
+	if config.FingerprintURLs {
+		doc.LinkURL = doc.URL + "?v=" + doc.Hash
+	}
+
+	if file.Metadata.Title != "" {
+		doc.Title = file.Metadata.Title
+	} else {
+		doc.Title = humanizeHenryName(henryOutputName(file))
+		if config.TitleFromHeading {
+			title, rest, err := extractHenryTitleHeading(doc.Content)
+			if err != nil {
+				return nil, err
+			}
+			if title != "" {
+				doc.Title = title
+				if config.StripTitleHeading {
+					doc.Content = rest
+				}
+			}
+		}
+	}
+
+	doc.Author = file.Metadata.Author
+
+	doc.Lang = config.Language
+	if file.Metadata.Lang != "" {
+		doc.Lang = file.Metadata.Lang
+	}
+
+	if !file.Metadata.Date.IsZero() {
+		doc.Date = file.Metadata.Date
+	} else if !file.NameDate.IsZero() {
+		doc.Date = file.NameDate
+	} else {
+		doc.Date = file.Date
+	}
+	if !file.Metadata.Date.IsZero() || !file.NameDate.IsZero() {
+		if err := checkHenryDate(doc.Date, time.Now(), config); err != nil {
+			err = errors.New(fmt.Sprintf("error parsing date in '%s': %s", file.Name, err))
+			if config.Strict {
+				return nil, &HenryStrictError{Err: err}
+			}
+			debug("warning: %s", err.Error())
+		}
+	}
+	doc.LastMod = henryLastMod(file)
+	doc.ModTime = file.Date
+	doc.Source = filepath.ToSlash(file.Path)
+	doc.GitInfo = file.GitInfo
+
+	if file.Metadata.Draft || file.Draft {
+		doc.Draft = true
+	} else {
+		doc.Draft = false
+	}
+
+	doc.NoIndex = file.Metadata.NoIndex || file.NotFound
+	doc.IsSection = file.IsSection
+	doc.Params = file.Metadata.Params
+
+	doc.Outputs = []string{"html"}
+	if len(file.Metadata.Outputs) > 0 {
+		doc.Outputs = file.Metadata.Outputs
+	}
+	for _, output := range doc.Outputs {
+		if output != "html" && output != "json" {
+			return nil, errors.New(fmt.Sprintf("error parsing metadata in '%s': unknown output '%s'", file.Name, output))
+		}
+	}
+	for _, name := range file.Metadata.Exclude {
+		switch name {
+		case "archive", "feed", "search", "sitemap", "tags":
+		default:
+			err := errors.New(fmt.Sprintf("error parsing metadata in '%s': unknown exclude '%s'", file.Name, name))
+			if config.Strict {
+				return nil, &HenryStrictError{Err: err}
+			}
+			debug("warning: %s", err.Error())
+		}
+	}
+	doc.Exclude = file.Metadata.Exclude
+	doc.Tags = file.Metadata.Tags
+
+	if file.Metadata.Summary != "" {
+		sh, err := RenderMarkdown(file.Metadata.Summary, RenderOptions{BasePath: basePath, Renderer: henryMarkdownRenderer(config)})
+		if err != nil {
+			return nil, err
+		}
+		doc.Summary = sh
+		doc.SummaryRaw = file.Metadata.Summary
+	} else {
+		if len(doc.ContentParagraphs) > 0 {
+			doc.Summary = doc.ContentParagraphs[0]
+		}
+	}
+
+	summaryText, err := stripHenryTags(doc.Summary)
+	if err != nil {
+		return nil, err
+	}
+	doc.SummaryText = summaryText
+
+	doc.Description = file.Metadata.Description
+	doc.MetaDescription = henryMetaDescription(doc)
+
+	doc.Teaser = file.Metadata.Teaser
+	if doc.Teaser == "" {
+		doc.Teaser = truncateHenryText(doc.SummaryText, 100)
+	}
+
+	switch config.SummaryFormat {
+	case "inline":
+		doc.Summary = unwrapHenryParagraph(doc.Summary)
+	case "plain":
+		doc.Summary = doc.SummaryText
+	}
+
+	return doc, nil
+}
+
+func createHenryDocuments(files []*HenryFile, config *HenryConfig) ([]*HenryDocument, error) {
+	docs := make([]*HenryDocument, 0)
+
+	built := make([]*HenryDocument, len(files))
+	errs := make([]error, len(files))
+
+	total := 0
+	for _, file := range files {
+		if isHenryDocumentFile(file) && !file.Metadata.Private && isHenryFileInEnvironment(file, config.Environment) {
+			total++
+		}
+	}
+
+	var progress *HenryProgress
+	if total > config.ProgressThreshold && !config.Quiet && isHenryTerminal(os.Stderr) {
+		progress = &HenryProgress{Out: os.Stderr, Label: "rendered", Total: total}
+	}
+
+	included := make(map[string]bool)
+	if !config.PublishIncludes {
+		for _, file := range files {
+			if !isHenryDocumentFile(file) {
+				continue
+			}
+			for _, include := range file.Metadata.Include {
+				included[henryIncludePath(file, include)] = true
+			}
+		}
+	}
+
+	resources := make(map[string][]*HenryResource)
+	for _, file := range files {
+		if file.Type != HenryFileTypeAsset {
+			continue
+		}
+		dir := strings.Trim(filepath.ToSlash(file.SubPath), "/")
+		resources[dir] = append(resources[dir], &HenryResource{
+			Name: file.Name,
+			URL:  henryBasePath(config) + "/" + henryAssetPath(file),
+		})
+	}
+
+	runHenryJobs(len(files), config.Jobs, func(i int) error {
+		if !isHenryDocumentFile(files[i]) || files[i].Metadata.Private || included[filepath.Clean(files[i].Path)] {
+			return nil
+		}
+		if !isHenryFileInEnvironment(files[i], config.Environment) {
+			return nil
+		}
+
+		if cached := henryCachedDocument(files[i], config); cached != nil {
+			built[i] = cached
+		} else {
+			built[i], errs[i] = createHenryDocument(files[i], config)
+		}
+		progress.Increment()
+		return nil
+	})
+
+	for i, doc := range built {
+		if errs[i] != nil {
+			if _, ok := errs[i].(*HenryStrictError); ok {
+				return nil, errs[i]
+			}
+			debug("%s", errs[i].Error())
+			continue
+		}
+
+		if doc != nil {
+			if files[i].IsBundle {
+				doc.Resources = resources[doc.SubPath]
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs, nil
+}
+
+func debug(params ...string) {
+	args := make([]interface{}, len(params)-1)
+	for i := 1; i < len(params); i++ {
+		args[i-1] = params[i]
+	}
+
+	henryLogger.Printf(params[0], args...)
+}
+
+func demoteHenryHeadings(content string, offset int) string {
+	if offset <= 0 {
+		return content
+	}
+
+	return henryHeadingPattern.ReplaceAllStringFunc(content, func(tag string) string {
+		parts := henryHeadingPattern.FindStringSubmatch(tag)
+		level, _ := strconv.Atoi(parts[2])
+		level += offset
+		if level > 6 {
+			level = 6
+		}
+		return fmt.Sprintf("<%sh%d", parts[1], level)
+	})
+}
+
+func expandHenryConfig(config *HenryConfig) error {
+	fields := []*string{
+		&config.Author, &config.BaseURL, &config.ContentDir, &config.DataDir, &config.Description,
+		&config.Environment, &config.Language, &config.Manifest, &config.OutputDir, &config.PostBuild, &config.PreBuild,
+		&config.RedirectsFile, &config.StaticDir, &config.TemplateDir, &config.Title,
+	}
+	for i := range config.ContentDirs {
+		fields = append(fields, &config.ContentDirs[i])
+	}
+	for i := range config.Remote {
+		fields = append(fields, &config.Remote[i].URL, &config.Remote[i].Path)
+	}
+
+	for _, field := range fields {
+		expanded, err := expandHenryString(*field, config.Strict)
+		if err != nil {
+			return err
+		}
+		*field = expanded
+	}
+
+	params, err := expandHenryValue(config.Params, config.Strict)
+	if err != nil {
+		return err
+	}
+	if params != nil {
+		config.Params = params.(map[string]interface{})
+	}
+
+	return nil
+}
+
+func expandHenryMetadata(metadata *HenryFileMetadata, strict bool) error {
+	fields := []*string{
+		&metadata.Author, &metadata.Description, &metadata.Lang, &metadata.Summary, &metadata.Teaser, &metadata.Title,
+	}
+	for i := range metadata.Tags {
+		fields = append(fields, &metadata.Tags[i])
+	}
+
+	for _, field := range fields {
+		expanded, err := expandHenryString(*field, strict)
+		if err != nil {
+			return err
+		}
+		*field = expanded
+	}
+
+	_, err := expandHenryValue(metadata.Params, strict)
+
+	return err
+}
+
+func expandHenryIncludes(file *HenryFile, config *HenryConfig, stack []string) (string, error) {
+	if len(file.Metadata.Include) == 0 {
+		return file.Body, nil
+	}
+
+	stack = append(stack, filepath.Clean(file.Path))
+
+	parts := []string{file.Body}
+	for _, include := range file.Metadata.Include {
+		includePath := henryIncludePath(file, include)
+		for _, seen := range stack {
+			if seen == includePath {
+				return "", errors.New(fmt.Sprintf("error including '%s' in '%s': include cycle", include, file.Name))
+			}
+		}
+
+		included := &HenryFile{Name: filepath.Base(includePath), Path: includePath}
+		if err := readHenryFileData(included); err != nil {
+			return "", errors.New(fmt.Sprintf("error including '%s' in '%s': %s", include, file.Name, err))
+		}
+		if err := readHenryFileMetadata(included, config); err != nil {
+			return "", err
+		}
+
+		body, err := expandHenryIncludes(included, config, stack)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, body)
+	}
+
+	return strings.Join(parts, "\n\n"), nil
+}
+
+func expandHenryString(value string, strict bool) (string, error) {
+	missing := make([]string, 0)
+
+	expanded := henryEnvPattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := match[2 : len(match)-1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return env
+	})
+
+	if strict && len(missing) > 0 {
+		return "", errors.New(fmt.Sprintf("undefined environment variable '%s'", missing[0]))
+	}
+
+	return expanded, nil
+}
+
+func expandHenryValue(value interface{}, strict bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandHenryString(v, strict)
+	case map[string]interface{}:
+		if v == nil {
+			return nil, nil
+		}
+		for key, item := range v {
+			expanded, err := expandHenryValue(item, strict)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, item := range v {
+			expanded, err := expandHenryValue(item, strict)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	case []map[string]interface{}:
+		for _, item := range v {
+			if _, err := expandHenryValue(item, strict); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return value, nil
+}
+
+func extractHenryTitleHeading(content string) (string, string, error) {
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return "", "", err
+	}
+
+	var heading *html.Node
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if heading != nil {
+			return
+		}
+		if node.Type == html.ElementNode && node.DataAtom == atom.H1 {
+			heading = node
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+	if heading == nil {
+		return "", content, nil
+	}
+
+	var buf bytes.Buffer
+	for child := heading.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.DataAtom == atom.A {
+			isAnchor := false
+			for _, attr := range child.Attr {
+				if attr.Key == "class" && attr.Val == "anchor" {
+					isAnchor = true
+				}
+			}
+			if isAnchor {
+				continue
+			}
+		}
+		if err := html.Render(&buf, child); err != nil {
+			return "", "", err
+		}
+	}
+
+	title, err := stripHenryTags(buf.String())
+	if err != nil {
+		return "", "", err
+	}
+
+	if heading.Parent != nil {
+		heading.Parent.RemoveChild(heading)
+	}
+
+	remaining := make([]*html.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node != heading {
+			remaining = append(remaining, node)
+		}
+	}
+
+	rest, err := renderHenryFragment(remaining)
+	if err != nil {
+		return "", "", err
+	}
+
+	return title, strings.TrimLeft(rest, "\n"), nil
+}
+
+func fetchHenryRemoteFile(client *http.Client, source HenryRemoteSource, config *HenryConfig) (*HenryFile, error) {
+	rel := source.Path
+	if rel == "" {
+		u, err := url.Parse(source.URL)
+		if err != nil {
+			return nil, err
+		}
+		rel = path.Base(u.Path)
+	}
+	if path.Ext(rel) != ".md" {
+		rel += ".md"
+	}
+
+	resp, err := client.Get(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	reader := io.Reader(resp.Body)
+	if config.MaxFileSize > 0 {
+		reader = io.LimitReader(resp.Body, config.MaxFileSize+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxFileSize > 0 && int64(len(data)) > config.MaxFileSize {
+		return nil, errors.New(fmt.Sprintf("response exceeds maxFileSize of %d bytes", config.MaxFileSize))
+	}
+
+	file := &HenryFile{
+		Name:    path.Base(rel),
+		Path:    source.URL,
+		SubPath: path.Dir("/" + rel),
+		Type:    HenryFileTypeMarkdown,
+		Data:    normalizeHenryLineEndings(data),
+		Date:    time.Now(),
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		file.Date = modified
+	}
+
+	if err := readHenryFileMetadata(file, config); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func fetchHenryRemoteFiles(config *HenryConfig) ([]*HenryFile, error) {
+	files := make([]*HenryFile, 0, len(config.Remote))
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for _, source := range config.Remote {
+		file, err := fetchHenryRemoteFile(client, source, config)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("error fetching '%s': %s", source.URL, err))
+			if config.Strict {
+				return nil, &HenryStrictError{Err: err}
+			}
+			debug("warning: %s", err.Error())
+			continue
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func filterHenryEmpty(docs []*HenryDocument, config *HenryConfig) []*HenryDocument {
+	kept := make([]*HenryDocument, 0, len(docs))
+	for _, doc := range docs {
+		if !isHenryDocumentEmpty(doc, config) {
+			kept = append(kept, doc)
+		}
+	}
+
+	return kept
+}
+
+func findHenryFiles(rootPath string, config *HenryConfig) ([]*HenryFile, error) {
+	foundFiles := make([]*HenryFile, 0)
+
+	start := time.Now()
+	err := filepath.Walk(rootPath, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !file.IsDir() {
+			foundFiles = append(foundFiles, &HenryFile{Name: file.Name(), Path: path})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	config.Timings.Add("walk", time.Since(start))
+
+	err = runHenryJobs(len(foundFiles), config.Jobs, func(i int) error {
+		return analyzeHenryFile(foundFiles[i], &rootPath, config)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	analyzedFiles := make([]*HenryFile, 0, len(foundFiles))
+	for _, file := range foundFiles {
+		if !file.Skipped {
+			analyzedFiles = append(analyzedFiles, file)
+		}
+	}
+	markHenryBundleResources(analyzedFiles)
+
+	return analyzedFiles, nil
+}
+
+func findHenrySourceFiles(rootPaths []string, config *HenryConfig) ([]*HenryFile, error) {
+	mergedFiles := make([]*HenryFile, 0)
+	index := make(map[string]int)
+
+	for _, rootPath := range rootPaths {
+		files, err := findHenryFiles(rootPath, config)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]*HenryFile)
+		for _, file := range files {
+			key := henryDocumentPath(file, config)
+			if !isHenryDocumentFile(file) {
+				key = henryAssetPath(file)
+			}
+			if other, ok := seen[key]; ok {
+				return nil, errors.New(fmt.Sprintf("error building '%s': '%s' and '%s' both write '%s'", rootPath, other.Path, file.Path, key))
+			}
+			seen[key] = file
+
+			if i, ok := index[key]; ok {
+				mergedFiles[i] = file
+				continue
+			}
+
+			index[key] = len(mergedFiles)
+			mergedFiles = append(mergedFiles, file)
+		}
+	}
+
+	return mergedFiles, nil
+}
+
+func findHenryParagraphs(content string) ([]string, error) {
+	paragraphs := make([]string, 0)
+
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var walk func(node *html.Node) error
+	walk = func(node *html.Node) error {
+		if node.Type == html.ElementNode && node.DataAtom == atom.P {
+			var buf bytes.Buffer
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				if err := html.Render(&buf, child); err != nil {
+					return err
+				}
+			}
+
+			inner := strings.TrimSpace(buf.String())
+			if inner != "" {
+				paragraphs = append(paragraphs, fmt.Sprintf("<p>%s</p>", inner))
+			}
+			return nil
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, node := range nodes {
+		if err := walk(node); err != nil {
+			return nil, err
+		}
+	}
+
+	return paragraphs, nil
+}
+
+func filterHenryExcluded(docs []*HenryDocument, name string) []*HenryDocument {
+	kept := make([]*HenryDocument, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.Excludes(name) {
+			kept = append(kept, doc)
+		}
+	}
+
+	return kept
+}
+
+func fingerprintHenryLinks(docs []*HenryDocument) error {
+	versioned := make(map[string]string)
+	for _, doc := range docs {
+		versioned[doc.URL] = doc.LinkURL
+	}
+
+	for _, doc := range docs {
+		if !strings.Contains(doc.Content, "href=") {
+			continue
+		}
+
+		nodes, err := parseHenryFragment(doc.Content)
+		if err != nil {
+			return err
+		}
+
+		var walk func(node *html.Node)
+		walk = func(node *html.Node) {
+			if node.Type == html.ElementNode && node.DataAtom == atom.A {
+				for i, attr := range node.Attr {
+					if attr.Key != "href" {
+						continue
+					}
+
+					target, fragment := attr.Val, ""
+					if i := strings.Index(target, "#"); i >= 0 {
+						target, fragment = target[:i], target[i:]
+					}
+					if link, ok := versioned[target]; ok {
+						node.Attr[i].Val = link + fragment
+					}
+				}
+			}
+
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				walk(child)
+			}
+		}
+
+		for _, node := range nodes {
+			walk(node)
+		}
+
+		content, err := renderHenryFragment(nodes)
+		if err != nil {
+			return err
+		}
+		doc.Content = content
+	}
+
+	return nil
+}
+
+func flattenHenryGemtext(node *blackfriday.Node) (string, []string) {
+	var buf bytes.Buffer
+	links := make([]string, 0)
+
+	node.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if !entering || n == node {
+			return blackfriday.GoToNext
+		}
+
+		switch n.Type {
+		case blackfriday.Text, blackfriday.Code:
+			buf.Write(n.Literal)
+		case blackfriday.Softbreak, blackfriday.Hardbreak:
+			buf.WriteString(" ")
+		case blackfriday.Link:
+			text, _ := flattenHenryGemtext(n)
+			buf.WriteString(text)
+			links = append(links, strings.TrimSpace("=> "+string(n.LinkData.Destination)+" "+text))
+			return blackfriday.SkipChildren
+		case blackfriday.Image:
+			text, _ := flattenHenryGemtext(n)
+			links = append(links, strings.TrimSpace("=> "+string(n.LinkData.Destination)+" "+text))
+			return blackfriday.SkipChildren
+		}
+
+		return blackfriday.GoToNext
+	})
+
+	return strings.Join(strings.Fields(buf.String()), " "), links
+}
+
+func (doc *HenryDocument) FeedSummary() string {
+	if doc.SummaryRaw == "" && doc.Description != "" {
+		return doc.Description
+	}
+
+	return doc.SummaryText
+}
+
+func (doc *HenryDocument) FirstParagraphs(n int) []string {
+	if n <= 0 {
+		return []string{}
+	}
+	if n > len(doc.ContentParagraphs) {
+		n = len(doc.ContentParagraphs)
+	}
+
+	return doc.ContentParagraphs[:n]
+}
+
+func (doc *HenryDocument) Excludes(name string) bool {
+	for _, e := range doc.Exclude {
+		if e == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (doc *HenryDocument) HasOutput(output string) bool {
+	for _, o := range doc.Outputs {
+		if o == output {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (doc *HenryDocument) JSON(config *HenryConfig) ([]byte, error) {
+	return marshalHenryJSON(HenryDocumentJSON{
+		ID:          doc.ID,
+		Title:       doc.Title,
+		URL:         doc.URL,
+		Author:      doc.Author,
+		Date:        doc.Date.Format(time.RFC3339),
+		LastMod:     doc.LastMod.Format(time.RFC3339),
+		Description: doc.Description,
+		Summary:     doc.FeedSummary(),
+		Tags:        doc.Tags,
+		Params:      henryPublicParams(doc.Params, config),
+		Content:     doc.Content,
+	}, config)
+}
+
+func (doc *HenryDocument) JSONLD(config *HenryConfig) (string, error) {
+	article := HenryJSONLDArticle{
+		Context:       "https://schema.org",
+		Type:          "Article",
+		Headline:      doc.Title,
+		DatePublished: doc.Date.Format(time.RFC3339),
+		DateModified:  doc.LastMod.Format(time.RFC3339),
+		Description:   doc.MetaDescription,
+	}
+
+	author := doc.Author
+	if author == "" && config != nil {
+		author = config.Author
+	}
+	if author != "" {
+		article.Author = &HenryJSONLDPerson{Type: "Person", Name: author}
+	}
+
+	data, err := json.Marshal(article)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func generateHenryJSONFeed(docs []*HenryDocument, now time.Time, config *HenryConfig) ([]byte, error) {
+	feed := HenryJSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       config.Title,
+		Description: config.Description,
+		Language:    config.Language,
+		Items:       make([]HenryJSONFeedItem, 0),
+	}
+	if config.BaseURL != "" {
+		feed.HomePageURL = henryAbsoluteURL(henryBasePath(config)+"/", config)
+		feed.FeedURL = henryAbsoluteURL(henryBasePath(config)+"/feed.json", config)
+	}
+
+	for _, doc := range recentHenryDocuments(filterHenryExcluded(docs, "feed"), len(docs), now, false) {
+		feed.Items = append(feed.Items, HenryJSONFeedItem{
+			ID:            doc.ID,
+			URL:           henryAbsoluteURL(doc.LinkURL, config),
+			Title:         doc.Title,
+			ContentHTML:   doc.Content,
+			Summary:       doc.FeedSummary(),
+			DatePublished: doc.Date.Format(time.RFC3339),
+			DateModified:  doc.LastMod.Format(time.RFC3339),
+			Tags:          doc.Tags,
+		})
+	}
+
+	return marshalHenryJSON(feed, config)
+}
+
+func generateHenryTagFeed(tag string, docs []*HenryDocument, config *HenryConfig) ([]byte, error) {
+	sorted := filterHenryExcluded(docs, "feed")
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	title := tag
+	if config.Title != "" {
+		title = fmt.Sprintf("%s: %s", config.Title, tag)
+	}
+
+	feed := HenryRSS{
+		Version: "2.0",
+		Channel: HenryRSSChannel{
+			Title:       title,
+			Link:        henryAbsoluteURL(henryBasePath(config)+"/", config),
+			Description: fmt.Sprintf("Documents tagged %s", tag),
+			Language:    config.Language,
+			Items:       make([]HenryRSSItem, 0, len(sorted)),
+		},
+	}
+
+	for _, doc := range sorted {
+		link := henryAbsoluteURL(doc.LinkURL, config)
+		feed.Channel.Items = append(feed.Channel.Items, HenryRSSItem{
+			Title:       doc.Title,
+			Link:        link,
+			GUID:        link,
+			PubDate:     doc.Date.Format(time.RFC1123Z),
+			Description: doc.FeedSummary(),
+		})
+	}
+
+	return marshalHenryXML(feed, config)
+}
+
+func groupHenryDocumentsByMonth(docs []*HenryDocument, now time.Time) []*HenryArchiveYear {
+	sorted := make([]*HenryDocument, 0, len(docs))
+	for _, doc := range docs {
+		if isHenryDocumentIndexed(doc, now, false) {
+			sorted = append(sorted, doc)
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	years := make([]*HenryArchiveYear, 0)
+	for _, doc := range sorted {
+		year, month := doc.Date.Year(), doc.Date.Month()
+
+		if len(years) == 0 || years[len(years)-1].Year != year {
+			years = append(years, &HenryArchiveYear{Year: year})
+		}
+		y := years[len(years)-1]
+
+		if len(y.Months) == 0 || y.Months[len(y.Months)-1].Month != month {
+			y.Months = append(y.Months, &HenryArchiveMonth{Month: month})
+		}
+		m := y.Months[len(y.Months)-1]
+
+		m.Documents = append(m.Documents, doc)
+	}
+
+	return years
+}
+
+func groupHenryDocumentsByTag(docs []*HenryDocument, now time.Time, drafts bool) map[string][]*HenryDocument {
+	groups := make(map[string][]*HenryDocument)
+
+	for _, doc := range docs {
+		if !isHenryDocumentIndexed(doc, now, drafts) {
+			continue
+		}
+
+		for _, tag := range doc.Tags {
+			groups[tag] = append(groups[tag], doc)
+		}
+	}
+
+	return groups
+}
+
+func henryAbsoluteURL(link string, config *HenryConfig) string {
+	base, err := url.Parse(config.BaseURL)
+	if err != nil || config.BaseURL == "" {
+		return link
+	}
+
+	ref, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	return base.ResolveReference(ref).String()
+}
+
+func henryAssetPath(file *HenryFile) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(file.SubPath, file.Name)), "/")
+}
+
+func henryBasePath(config *HenryConfig) string {
+	if config.BaseURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(config.BaseURL)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+func henryCachedDocument(file *HenryFile, config *HenryConfig) *HenryDocument {
+	if config.Since.IsZero() || !file.Date.Before(config.Since) {
+		return nil
+	}
+
+	return config.DocumentCache[filepath.ToSlash(file.Path)]
+}
+
+func henryCodePlaceholder(index int) string {
+	return fmt.Sprintf("HENRYCODE%dX", index)
+}
+
+func henryDirMode(config *HenryConfig) os.FileMode {
+	mode, err := strconv.ParseUint(config.DirMode, 8, 32)
+	if err != nil {
+		return 0755
+	}
+
+	return os.FileMode(mode)
+}
+
+func henryDocumentID(file *HenryFile) string {
+	name := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+	key := strings.Trim(filepath.ToSlash(file.SubPath), "/")
+	if key != "" {
+		key += "/"
+	}
+	key = strings.ToLower(key + name)
+
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func henryDocumentPath(file *HenryFile, config *HenryConfig) string {
+	if file.NotFound {
+		return "404.html"
+	}
+	if file.Metadata != nil && file.Metadata.OutputPath != "" {
+		return file.Metadata.OutputPath
+	}
+
+	name := henryOutputName(file)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if file.IsSection {
+		name = "index"
+	}
+	if config.PrettyURLs && !config.UglyURLs && name != "index" {
+		name = filepath.Join(name, "index")
+	}
+
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(file.SubPath, name+".html")), "/")
+}
+
+func henryDocumentURL(doc *HenryDocument, config *HenryConfig) string {
+	u := "/" + doc.Path
+	if config.UglyURLs {
+		return henryBasePath(config) + u
+	}
+	if path.Base(u) == "index.html" {
+		u = strings.TrimSuffix(u, "index.html")
+	}
+
+	return henryBasePath(config) + normalizeHenryURL(u, config.TrailingSlash)
+}
+
+func henryExitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return HenryExitSuccess
+	case *HenryUsageError:
+		return HenryExitUsageError
+	case *HenryStrictError:
+		return HenryExitStrictError
+	default:
+		return HenryExitBuildError
+	}
+}
+
+func henryFileMode(config *HenryConfig) os.FileMode {
+	mode, err := strconv.ParseUint(config.FileMode, 8, 32)
+	if err != nil {
+		return 0644
+	}
+
+	return os.FileMode(mode)
+}
+
+func henryGeneratorRecords(data map[string]interface{}, key string) ([]map[string]interface{}, error) {
+	var value interface{} = data
+	for _, part := range strings.Split(key, ".") {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no data at '%s'", key))
+		}
+		value, ok = table[part]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no data at '%s'", key))
+		}
+	}
+
+	switch list := value.(type) {
+	case []map[string]interface{}:
+		return list, nil
+	case []interface{}:
+		records := make([]map[string]interface{}, 0, len(list))
+		for _, item := range list {
+			record, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("data at '%s' is not a list of records", key))
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("data at '%s' is not a list of records", key))
+}
+
+func henryGeneratorPath(pattern string, record map[string]interface{}, config *HenryConfig) (string, error) {
+	var missing string
+	rel := henryGeneratorField.ReplaceAllStringFunc(pattern, func(match string) string {
+		field := match[1 : len(match)-1]
+		value, ok := record[field]
+		if !ok {
+			missing = field
+			return ""
+		}
+		return slugifyHenry(fmt.Sprint(value), config)
+	})
+	if missing != "" {
+		return "", errors.New(fmt.Sprintf("record has no field '%s'", missing))
+	}
+
+	return strings.TrimPrefix(path.Clean("/"+rel), "/"), nil
+}
+
+func henryHeadingID(node *html.Node, seen map[string]int, config *HenryConfig) string {
+	for _, attr := range node.Attr {
+		if attr.Key == "id" && attr.Val != "" {
+			return attr.Val
+		}
+	}
+
+	text, _ := renderHenryFragment([]*html.Node{node})
+	text, _ = stripHenryTags(text)
+	id := slugifyHenry(text, config)
+	if id == "" {
+		id = "section"
+	}
+	if n := seen[id]; n > 0 {
+		seen[id] = n + 1
+		id = fmt.Sprintf("%s-%d", id, n)
+	} else {
+		seen[id] = 1
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: "id", Val: id})
+
+	return id
+}
+
+func henryHeadingText(node *html.Node) string {
+	var buf strings.Builder
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			buf.WriteString(node.Data)
+			return
+		}
+		if node.DataAtom == atom.A {
+			for _, attr := range node.Attr {
+				if attr.Key == "class" && attr.Val == "anchor" {
+					return
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+func henryIncludePath(file *HenryFile, include string) string {
+	return filepath.Clean(filepath.Join(filepath.Dir(file.Path), filepath.FromSlash(include)))
+}
+
+func henryLastMod(file *HenryFile) time.Time {
+	if !file.Metadata.LastMod.IsZero() {
+		return file.Metadata.LastMod
+	}
+
+	if file.GitInfo != nil && !file.GitInfo.Date.IsZero() {
+		return file.GitInfo.Date
+	}
+
+	return file.Date
+}
+
+func henryDocumentRenderer(file *HenryFile, config *HenryConfig) MarkdownRenderer {
+	switch file.Type {
+	case HenryFileTypeHTML:
+		return &HenryHTMLRenderer{}
+	case HenryFileTypePlain:
+		return &HenryPlainRenderer{}
+	}
+
+	return henryMarkdownRenderer(config)
+}
+
+func henryMarkdownRenderer(config *HenryConfig) MarkdownRenderer {
+	if config.Markdown.Engine == "goldmark" {
+		return &HenryGoldmarkRenderer{Smartypants: config.Smartypants}
+	}
+
+	return &HenryBlackfridayRenderer{Smartypants: config.Smartypants}
+}
+
+func henryMetaDescription(doc *HenryDocument) string {
+	if doc.Description != "" {
+		return doc.Description
+	}
+
+	return truncateHenryText(doc.SummaryText, 160)
+}
+
+func henryMathPlaceholder(index int) string {
+	return fmt.Sprintf("HENRYMATH%dX", index)
+}
+
+func henryOutputName(file *HenryFile) string {
+	if file.OutputName != "" {
+		return file.OutputName
+	}
+
+	return file.Name
+}
+
+func henryPublicParams(params map[string]interface{}, config *HenryConfig) map[string]interface{} {
+	public := make(map[string]interface{})
+
+	for key, value := range params {
+		excluded := false
+		for _, exclude := range config.ExcludeParams {
+			if strings.EqualFold(key, exclude) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			public[key] = value
+		}
+	}
+
+	if len(public) == 0 {
+		return nil
+	}
+
+	return public
+}
+
+func humanizeHenryName(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = strings.NewReplacer("-", " ", "_", " ").Replace(name)
+
+	words := strings.Fields(name)
+	for i, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+
+	return strings.Join(words, " ")
+}
+
+func (l *HenryPathList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *HenryPathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (p *HenryProgress) Increment() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Done++
+
+	step := p.Total / 100
+	if step < 1 {
+		step = 1
+	}
+	if p.Done%step == 0 || p.Done == p.Total {
+		fmt.Fprintf(p.Out, "\r%s %d/%d", p.Label, p.Done, p.Total)
+		if p.Done == p.Total {
+			fmt.Fprintln(p.Out)
+		}
+	}
+}
+
+func (l *HenryOutputLog) Record(path string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.Paths = append(l.Paths, path)
+}
+
+func (l *HenryOutputLog) Sorted() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seen := make(map[string]bool)
+	paths := make([]string, 0, len(l.Paths))
+	for _, path := range l.Paths {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func injectHenryDraftBanner(data []byte) []byte {
+	loc := henryBodyPattern.FindIndex(data)
+	if loc == nil {
+		return append([]byte(henryDraftBanner), data...)
+	}
+
+	out := make([]byte, 0, len(data)+len(henryDraftBanner))
+	out = append(out, data[:loc[1]]...)
+	out = append(out, henryDraftBanner...)
+	return append(out, data[loc[1]:]...)
+}
+
+func (t *HenryTimings) Add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Durations == nil {
+		t.Durations = make(map[string]time.Duration)
+	}
+	if _, ok := t.Durations[phase]; !ok {
+		t.Phases = append(t.Phases, phase)
+	}
+	t.Durations[phase] += d
+}
+
+func (t *HenryTimings) Print(out io.Writer) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, phase := range t.Phases {
+		fmt.Fprintf(out, "%-12s %s\n", phase, t.Durations[phase])
+	}
+}
+
+func insertHenryTOC(content string, config *HenryConfig) (string, error) {
+	placeholder := "<p>" + html.EscapeString(config.TOCMarker) + "</p>"
+	if !strings.Contains(content, placeholder) {
+		return content, nil
+	}
+
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return "", err
+	}
+
+	var toc strings.Builder
+	levels := make([]int, 0)
+	seen := make(map[string]int)
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch node.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				level := int(node.Data[1] - '0')
+				id := henryHeadingID(node, seen, config)
+
+				for len(levels) > 0 && levels[len(levels)-1] > level {
+					toc.WriteString("</li></ul>")
+					levels = levels[:len(levels)-1]
+				}
+				if len(levels) > 0 && levels[len(levels)-1] == level {
+					toc.WriteString("</li>")
+				} else {
+					toc.WriteString("<ul>")
+					levels = append(levels, level)
+				}
+				toc.WriteString(fmt.Sprintf(`<li><a href="#%s">%s</a>`, html.EscapeString(id), html.EscapeString(henryHeadingText(node))))
+				return
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	for _, node := range nodes {
+		walk(node)
+	}
+	for range levels {
+		toc.WriteString("</li></ul>")
+	}
+
+	content, err = renderHenryFragment(nodes)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Replace(content, placeholder, `<nav class="toc">`+toc.String()+`</nav>`, -1), nil
+}
+
+func isHenryDocumentEmpty(doc *HenryDocument, config *HenryConfig) bool {
+	return config.SkipEmpty && strings.TrimSpace(doc.ContentRaw) == ""
+}
+
+func isHenryDocumentIndexed(doc *HenryDocument, now time.Time, drafts bool) bool {
+	return isHenryDocumentPublished(doc, now, drafts) && !doc.NoIndex && !doc.IsSection
+}
+
+func isHenryDocumentPublished(doc *HenryDocument, now time.Time, drafts bool) bool {
+	return (drafts || !doc.Draft) && !doc.Date.After(now)
+}
+
+func isHenryDocumentFile(file *HenryFile) bool {
+	switch file.Type {
+	case HenryFileTypeMarkdown, HenryFileTypeHTML, HenryFileTypePlain:
+		return true
+	}
+
+	return false
+}
+
+func isHenryFileInEnvironment(file *HenryFile, env string) bool {
+	if len(file.Metadata.Environments) == 0 {
+		return true
+	}
+
+	for _, e := range file.Metadata.Environments {
+		if strings.EqualFold(e, env) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHenryOutputCurrent(rel string, doc *HenryDocument, config *HenryConfig) bool {
+	if config.Since.IsZero() || !doc.ModTime.Before(config.Since) {
+		return false
+	}
+
+	if _, err := os.Stat(filepath.Join(config.OutputDir, filepath.FromSlash(rel))); err != nil {
+		return false
+	}
+	config.OutputLog.Record(rel)
+
+	return true
+}
+
+func isHenryRelativeURL(value string) bool {
+	if value == "" || strings.HasPrefix(value, "/") || strings.HasPrefix(value, "#") {
+		return false
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == "" && u.Host == ""
+}
+
+func isHenryTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func lazyHenryImages(content string, opts RenderOptions) (string, error) {
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return "", err
+	}
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Img {
+			attrs := make(map[string]string)
+			for _, attr := range node.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+
+			if _, ok := attrs["loading"]; !ok {
+				node.Attr = append(node.Attr, html.Attribute{Key: "loading", Val: "lazy"})
+			}
+			if _, ok := attrs["decoding"]; !ok {
+				node.Attr = append(node.Attr, html.Attribute{Key: "decoding", Val: "async"})
+			}
+
+			_, hasWidth := attrs["width"]
+			_, hasHeight := attrs["height"]
+			if !hasWidth && !hasHeight {
+				if width, height, ok := readHenryImageSize(attrs["src"], opts); ok {
+					node.Attr = append(node.Attr,
+						html.Attribute{Key: "width", Val: strconv.Itoa(width)},
+						html.Attribute{Key: "height", Val: strconv.Itoa(height)})
+				}
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	for _, node := range nodes {
+		walk(node)
+	}
+
+	return renderHenryFragment(nodes)
+}
+
+func lockHenryOutput(config *HenryConfig) (string, error) {
+	if err := os.MkdirAll(config.OutputDir, henryDirMode(config)); err != nil {
+		return "", err
+	}
+
+	lockPath := filepath.Join(config.OutputDir, ".henry.lock")
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, henryFileMode(config))
+	if err != nil {
+		if os.IsExist(err) {
+			return "", errors.New(fmt.Sprintf("output directory '%s' is locked by another build (remove '%s' if it is stale)", config.OutputDir, lockPath))
+		}
+		return "", err
+	}
+
+	fmt.Fprintf(lock, "%d\n", os.Getpid())
+	if err := lock.Close(); err != nil {
+		os.Remove(lockPath)
+		return "", err
+	}
+	if err := os.Chmod(lockPath, henryFileMode(config)); err != nil {
+		os.Remove(lockPath)
+		return "", err
+	}
+
+	return lockPath, nil
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+	}
+
+	os.Exit(henryExitCode(err))
+}
+
+func markHenryBundleResources(files []*HenryFile) {
+	bundles := make(map[string]bool)
+	for _, file := range files {
+		if file.IsBundle {
+			bundles[file.SubPath] = true
+		}
+	}
+
+	for _, file := range files {
+		if file.Type == HenryFileTypeUnknown && bundles[file.SubPath] {
+			file.Type = HenryFileTypeAsset
+		}
+	}
+}
+
+func markHenryContentAssets(files []*HenryFile, docs []*HenryDocument, config *HenryConfig) error {
+	candidates := make(map[string]*HenryFile)
+	for _, file := range files {
+		if file.Type == HenryFileTypeUnknown {
+			candidates["/"+henryAssetPath(file)] = file
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	basePath := henryBasePath(config)
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Img {
+			for _, attr := range node.Attr {
+				if attr.Key != "src" {
+					continue
+				}
+				u, err := url.Parse(attr.Val)
+				if err != nil || u.Scheme != "" || u.Host != "" {
+					continue
+				}
+				if file, ok := candidates[strings.TrimPrefix(u.Path, basePath)]; ok {
+					file.Type = HenryFileTypeAsset
+				}
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	for _, doc := range docs {
+		if !strings.Contains(doc.Content, "<img") {
+			continue
+		}
+
+		nodes, err := parseHenryFragment(doc.Content)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			walk(node)
+		}
+	}
+
+	return nil
+}
+
+func marshalHenryJSON(v interface{}, config *HenryConfig) ([]byte, error) {
+	if config.Pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+
+	return json.Marshal(v)
+}
+
+func marshalHenryXML(v interface{}, config *HenryConfig) ([]byte, error) {
+	if config.Pretty {
+		data, err := xml.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), data...), nil
+	}
+
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(strings.TrimSuffix(xml.Header, "\n")), data...), nil
+}
+
+func (e *HenryStrictError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HenryUsageError) Error() string {
+	return e.Err.Error()
+}
+
+func normalizeHenryHTML(data []byte) ([]byte, error) {
+	var nodes []*html.Node
+	if bytes.Contains(bytes.ToLower(data), []byte("<html")) {
+		doc, err := html.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		for child := doc.FirstChild; child != nil; child = child.NextSibling {
+			nodes = append(nodes, child)
+		}
+	} else {
+		fragment, err := parseHenryFragment(string(data))
+		if err != nil {
+			return nil, err
+		}
+		nodes = fragment
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if node.Type == html.TextNode && strings.TrimSpace(node.Data) == "" {
+			continue
+		}
+
+		normalizeHenryNode(node, 0)
+		if err := html.Render(&buf, node); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func normalizeHenryLineEndings(data []byte) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+}
+
+func normalizeHenryNode(node *html.Node, depth int) {
+	if node.Type != html.ElementNode {
+		return
+	}
+
+	sort.SliceStable(node.Attr, func(i, j int) bool {
+		if node.Attr[i].Namespace != node.Attr[j].Namespace {
+			return node.Attr[i].Namespace < node.Attr[j].Namespace
+		}
+		return node.Attr[i].Key < node.Attr[j].Key
+	})
+
+	switch node.DataAtom {
+	case atom.Pre, atom.Textarea, atom.Script, atom.Style:
+		return
+	}
+
+	blocks := 0
+	inline := false
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.ElementNode && henryBlockElements[child.DataAtom]:
+			blocks++
+		case child.Type == html.TextNode && strings.TrimSpace(child.Data) == "":
+		case child.Type == html.CommentNode:
+		default:
+			inline = true
+		}
+	}
+
+	if blocks > 0 && !inline {
+		for child := node.FirstChild; child != nil; {
+			next := child.NextSibling
+			if child.Type == html.TextNode {
+				node.RemoveChild(child)
+			}
+			child = next
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			node.InsertBefore(&html.Node{Type: html.TextNode, Data: "\n" + strings.Repeat("  ", depth+1)}, child)
+		}
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: "\n" + strings.Repeat("  ", depth)})
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		normalizeHenryNode(child, depth+1)
+	}
+}
+
+func normalizeHenryURL(u string, trailingSlash string) string {
+	if path.Ext(u) != "" {
+		return u
+	}
+
+	switch trailingSlash {
+	case "add":
+		if !strings.HasSuffix(u, "/") {
+			u += "/"
+		}
+	case "remove":
+		if u != "/" {
+			u = strings.TrimSuffix(u, "/")
+		}
+	}
+
+	return u
+}
+
+func packHenryOutput(archivePath string, config *HenryConfig) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	paths := config.OutputLog.Sorted()
+
+	if strings.HasSuffix(archivePath, ".zip") {
+		zw := zip.NewWriter(out)
+		for _, rel := range paths {
+			data, err := ioutil.ReadFile(filepath.Join(config.OutputDir, filepath.FromSlash(rel)))
+			if err != nil {
+				return err
+			}
+
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: rel, Method: zip.Deflate, Modified: time.Now()})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		return out.Close()
+	}
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	for _, rel := range paths {
+		data, err := ioutil.ReadFile(filepath.Join(config.OutputDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{Name: rel, Mode: int64(henryFileMode(config)), Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func parseHenryFragment(content string) ([]*html.Node, error) {
+	return html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+}
+
+func parseHenryTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+func printHenryScheduled(out io.Writer, docs []*HenryDocument) {
+	for _, doc := range docs {
+		fmt.Fprintf(out, "%s %s\n", doc.Date.Format("2006-01-02 15:04"), doc.Path)
+	}
+}
+
+func protectHenryMath(body string) (string, []string) {
+	var out bytes.Buffer
+	var chunk bytes.Buffer
+	spans := make([]string, 0)
+	fence := ""
+
+	flush := func() {
+		out.WriteString(protectHenryMathSpans(chunk.String(), &spans))
+		chunk.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(body, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if len(line)-len(trimmed) < 4 && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")) {
+			if fence == "" {
+				flush()
+				fence = trimmed[:3]
+			} else if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+				out.WriteString(line)
+				continue
+			}
+		}
+
+		if fence != "" {
+			out.WriteString(line)
+		} else {
+			chunk.WriteString(line)
+		}
+	}
+	flush()
+
+	return out.String(), spans
+}
+
+func protectHenryMathSpans(text string, spans *[]string) string {
+	var out bytes.Buffer
+
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\' && i+1 < len(text):
+			out.WriteString(text[i : i+2])
+			i += 2
+		case text[i] == '`':
+			run := i
+			for run < len(text) && text[run] == '`' {
+				run++
+			}
+			ticks := text[i:run]
+			end := strings.Index(text[run:], ticks)
+			if end < 0 {
+				out.WriteString(ticks)
+				i = run
+				continue
+			}
+			end += run + len(ticks)
+			out.WriteString(text[i:end])
+			i = end
+		case strings.HasPrefix(text[i:], "$$"):
+			end := strings.Index(text[i+2:], "$$")
+			if end < 0 {
+				out.WriteString("$$")
+				i += 2
+				continue
+			}
+			end += i + 4
+			out.WriteString(henryMathPlaceholder(len(*spans)))
+			*spans = append(*spans, text[i:end])
+			i = end
+		case text[i] == '$':
+			end := strings.IndexAny(text[i+1:], "$`\n")
+			if end <= 0 || text[i+1+end] != '$' || text[i+1] == ' ' || text[i+end] == ' ' ||
+				(i+2+end < len(text) && text[i+2+end] >= '0' && text[i+2+end] <= '9') {
+				out.WriteByte('$')
+				i++
+				continue
+			}
+			end += i + 2
+			out.WriteString(henryMathPlaceholder(len(*spans)))
+			*spans = append(*spans, text[i:end])
+			i = end
+		default:
+			out.WriteByte(text[i])
+			i++
+		}
+	}
+
+	return out.String()
+}
+
+func readHenryConfig(path string, strict bool) (*HenryConfig, error) {
+	config := &HenryConfig{
+		ContentDir:        "content",
+		DataDir:           "data",
+		DirMode:           "0755",
+		Environment:       "production",
+		FileMode:          "0644",
+		Jobs:              runtime.NumCPU(),
+		Language:          "en",
+		Markdown:          HenryMarkdownConfig{Engine: "blackfriday"},
+		MaxFileSize:       10 << 20,
+		MaxYearsAhead:     5,
+		MinYear:           1990,
+		ProgressThreshold: 500,
+		PublishIncludes:   true,
+		OutputDir:         "public",
+		OutputFormat:      "html",
+		RecentCount:       5,
+		RedirectsFile:     "redirects.toml",
+		Smartypants:       true,
+		SitemapLimit:      50000,
+		SortKey:           "none",
+		StaticDir:         "static",
+		SummaryFormat:     "block",
+		TemplateDir:       "templates",
+		TrailingSlash:     "preserve",
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if _, err := toml.DecodeFile(path, config); err != nil {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': %s", path, err))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if strict {
+		config.Strict = true
+	}
+
+	if err := expandHenryConfig(config); err != nil {
+		return nil, &HenryStrictError{Err: errors.New(fmt.Sprintf("error parsing config '%s': %s", path, err))}
+	}
+
+	switch config.SortKey {
+	case "none", "date", "title":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown sortKey '%s'", path, config.SortKey))
+	}
+
+	switch config.SummaryFormat {
+	case "block", "inline", "plain":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown summaryFormat '%s'", path, config.SummaryFormat))
+	}
+
+	for _, mode := range []string{config.FileMode, config.DirMode} {
+		if value, err := strconv.ParseUint(mode, 8, 32); err != nil || value > 0777 {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': invalid mode '%s'", path, mode))
+		}
+	}
+
+	switch config.Markdown.Engine {
+	case "blackfriday", "goldmark":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown markdown engine '%s'", path, config.Markdown.Engine))
+	}
+
+	if config.FilenameDate != "" {
+		pattern, err := regexp.Compile(config.FilenameDate)
+		if err != nil || pattern.NumSubexp() < 1 {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': invalid filenameDate '%s'", path, config.FilenameDate))
+		}
+		config.FilenameDatePattern = pattern
+	}
+
+	for _, generator := range config.Generators {
+		if generator.Template == "" || generator.Data == "" || generator.Path == "" {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': generators need a template, data and path", path))
+		}
+	}
+
+	for _, name := range config.Transform {
+		if _, ok := henryMetadataTransformers[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown transform '%s'", path, name))
+		}
+	}
+
+	for ext, kind := range config.Types {
+		if _, ok := henryFileTypes[kind]; !ok || !strings.HasPrefix(ext, ".") {
+			return nil, errors.New(fmt.Sprintf("error parsing config '%s': invalid type '%s' for '%s'", path, kind, ext))
+		}
+	}
+
+	switch config.Manifest {
+	case "", "json", "sums":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown manifest '%s'", path, config.Manifest))
+	}
+
+	switch config.OutputFormat {
+	case "html", "gemini":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown outputFormat '%s'", path, config.OutputFormat))
+	}
+
+	switch config.TrailingSlash {
+	case "add", "remove", "preserve":
+	default:
+		return nil, errors.New(fmt.Sprintf("error parsing config '%s': unknown trailingSlash '%s'", path, config.TrailingSlash))
+	}
+
+	return config, nil
+}
+
+func readHenryData(dataDir string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil
+		}
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(file.Name())
+		key := strings.TrimSuffix(file.Name(), ext)
+		path := filepath.Join(dataDir, file.Name())
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value map[string]interface{}
+		switch ext {
+		case ".toml":
+			err = toml.Unmarshal(raw, &value)
+		case ".json":
+			err = json.Unmarshal(raw, &value)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(raw, &value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("error parsing data file '%s': %s", path, err))
+		}
+
+		data[key] = value
+	}
+
+	return data, nil
+}
+
+func readHenryDocumentCache() (HenryDocumentCache, error) {
+	data, err := ioutil.ReadFile(henryCacheFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache := make(HenryDocumentCache)
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, errors.New(fmt.Sprintf("error parsing cache '%s': %s", henryCacheFile, err))
+	}
+
+	return cache, nil
+}
+
+func readHenryGitInfo(path string) *HenryGitInfo {
+	cmd := exec.Command("git", "log", "-1", "--format=%H %cI", "--", filepath.Base(path))
+	cmd.Dir = filepath.Dir(path)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return nil
+	}
+
+	date, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return nil
+	}
+
+	info := &HenryGitInfo{Hash: fields[0], AbbreviatedHash: fields[0], Date: date}
+	if len(info.Hash) > 7 {
+		info.AbbreviatedHash = info.Hash[:7]
+	}
+
+	return info
+}
+
+func readHenryImageSize(src string, opts RenderOptions) (int, int, bool) {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return 0, 0, false
+	}
+
+	rel := strings.TrimPrefix(u.Path, "/")
+	if isHenryRelativeURL(src) {
+		rel = path.Join(opts.DocumentDir, u.Path)
+	}
+
+	for _, root := range opts.ImageRoots {
+		if root == "" {
+			continue
+		}
+
+		in, err := os.Open(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(in)
+		in.Close()
+		if err == nil {
+			return cfg.Width, cfg.Height, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+func readHenryRedirects(path string) ([]HenryRedirect, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+
+	var table HenryRedirectTable
+	if _, err := toml.DecodeFile(path, &table); err != nil {
+		return nil, errors.New(fmt.Sprintf("error parsing redirects '%s': %s", path, err))
+	}
+
+	for i := range table.Redirects {
+		redirect := &table.Redirects[i]
+		if redirect.Status == 0 {
+			redirect.Status = 301
+		}
+		if redirect.From == "" || redirect.To == "" {
+			return nil, errors.New(fmt.Sprintf("error parsing redirects '%s': redirect %d needs both from and to", path, i+1))
+		}
+		if redirect.Status != 301 && redirect.Status != 302 {
+			return nil, errors.New(fmt.Sprintf("error parsing redirects '%s': unsupported status %d for '%s'", path, redirect.Status, redirect.From))
+		}
+	}
+
+	return table.Redirects, nil
+}
+
+func readHenryTemplates(config *HenryConfig) (*template.Template, error) {
+	source := config.TemplateDir
+	var fsys fs.FS = os.DirFS(config.TemplateDir)
+
+	paths, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		source = "embedded defaults"
+		fsys, err = fs.Sub(henryDefaultTemplates, "defaults/templates")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tmpl := template.New("").Funcs(henryTemplateFuncs)
+	if config.Strict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+
+	tmpl, err = tmpl.ParseFS(fsys, "*.html")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error parsing templates in '%s': %s", source, err))
+	}
+
+	return tmpl, nil
+}
+
+func readHenryEnvFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(normalizeHenryLineEndings(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return errors.New(fmt.Sprintf("error parsing env file '%s': line %d is not KEY=VALUE", path, i+1))
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return errors.New(fmt.Sprintf("error parsing env file '%s': line %d: %s", path, i+1, err))
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if hash := strings.Index(value, " #"); hash >= 0 {
+				value = strings.TrimSpace(value[:hash])
+			}
+		}
+
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	return nil
+}
+
+func readHenryFileData(file *HenryFile) error {
+	fo, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer fo.Close()
+
+	data, err := ioutil.ReadAll(fo)
+	if err != nil {
+		return err
+	}
+
+	file.Data = normalizeHenryLineEndings(data)
+
+	return nil
+}
+
+func readHenryFileMetadata(file *HenryFile, config *HenryConfig) error {
+	var metadata HenryFileMetadata
+
+	file.HasMetadata = false
+	file.Metadata = &metadata
+
+	delimiter, header, body, err := splitHenryFrontmatter(string(file.Data), config.FrontmatterDelimiter)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error parsing metadata in '%s': %s", file.Name, err))
+	}
+	if delimiter == "" {
+		file.Body = string(file.Data)
+		transformHenryMetadata(file.Metadata, config)
+		return nil
+	}
+
+	switch {
+	case strings.TrimSpace(header) == "":
+	case delimiter == "---":
+		if yamlErr := yaml.Unmarshal([]byte(header), &metadata); yamlErr != nil {
+			metadata = HenryFileMetadata{}
+			if _, err := toml.Decode(header, &metadata); err != nil {
+				return errors.New(fmt.Sprintf("error parsing metadata in '%s': %s", file.Name, yamlErr))
+			}
+		}
+	default:
+		if _, err := toml.Decode(header, &metadata); err != nil {
+			return errors.New(fmt.Sprintf("error parsing metadata in '%s': %s", file.Name, err))
+		}
+	}
+
+	if err := expandHenryMetadata(&metadata, config.Strict); err != nil {
+		return &HenryStrictError{Err: errors.New(fmt.Sprintf("error parsing metadata in '%s': %s", file.Name, err))}
+	}
+
+	if metadata.OutputPath != "" {
+		clean := path.Clean(filepath.ToSlash(metadata.OutputPath))
+		if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return errors.New(fmt.Sprintf("error parsing metadata in '%s': outputPath '%s' is outside the output directory", file.Name, metadata.OutputPath))
+		}
+		metadata.OutputPath = clean
 	}
 
 	file.HasMetadata = true
 	file.Metadata = &metadata
-	file.Body = headerParts[2]
+	file.Body = body
+	transformHenryMetadata(file.Metadata, config)
+
+	return nil
+}
+
+func recentHenryDocuments(docs []*HenryDocument, count int, now time.Time, drafts bool) []*HenryDocument {
+	recent := make([]*HenryDocument, 0)
+
+	for _, doc := range docs {
+		if isHenryDocumentIndexed(doc, now, drafts) {
+			recent = append(recent, doc)
+		}
+	}
+
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Date.After(recent[j].Date)
+	})
+
+	if count < 0 {
+		count = 0
+	}
+	if len(recent) > count {
+		recent = recent[:count]
+	}
+
+	return recent
+}
+
+func RenderDocumentHTML(doc *HenryDocument, tmpl *template.Template) (string, error) {
+	return renderHenryDocumentHTML(doc, &HenrySite{}, tmpl)
+}
+
+func RenderMarkdown(body string, opts RenderOptions) (string, error) {
+	policy := opts.Policy
+	if policy == nil {
+		policy = bluemonday.UGCPolicy()
+	}
+
+	spans := make([]string, 0)
+	if opts.Math {
+		body, spans = protectHenryMath(body)
+	}
+
+	renderer := opts.Renderer
+	if renderer == nil {
+		renderer = &HenryBlackfridayRenderer{Smartypants: true}
+	}
+
+	u := renderer.Render([]byte(body))
+
+	blocks := make([][]byte, 0)
+	if opts.ProtectCode {
+		u = henryCodePattern.ReplaceAllFunc(u, func(block []byte) []byte {
+			blocks = append(blocks, block)
+			return []byte(henryCodePlaceholder(len(blocks) - 1))
+		})
+	}
+
+	h := string(policy.SanitizeBytes(u))
+	for i, block := range blocks {
+		h = strings.Replace(h, henryCodePlaceholder(i), string(block), 1)
+	}
+	content := strings.Replace(h, "\n\n", "\n", -1)
+	content = strings.Trim(content, "\n")
+
+	for i, span := range spans {
+		content = strings.Replace(content, henryMathPlaceholder(i), html.EscapeString(span), 1)
+	}
+
+	content = demoteHenryHeadings(content, opts.HeadingOffset)
+
+	if opts.HeadingAnchors && henryHeadingPattern.MatchString(content) {
+		anchored, err := anchorHenryHeadings(content, &HenryConfig{Slug: opts.Slug})
+		if err != nil {
+			return "", err
+		}
+		content = anchored
+	}
+
+	if opts.LazyImages && strings.Contains(content, "<img") {
+		lazy, err := lazyHenryImages(content, opts)
+		if err != nil {
+			return "", err
+		}
+		content = lazy
+	}
+
+	if opts.BasePath != "" || (opts.ResolveImages && strings.Contains(content, "<img")) {
+		rewritten, err := rewriteHenryLinks(content, opts)
+		if err != nil {
+			return "", err
+		}
+		content = rewritten
+	}
+
+	return content, nil
+}
+
+func (r *HenryBlackfridayRenderer) Render(source []byte) []byte {
+	flags := blackfriday.CommonHTMLFlags
+	if !r.Smartypants {
+		flags &^= blackfriday.Smartypants | blackfriday.SmartypantsFractions | blackfriday.SmartypantsDashes | blackfriday.SmartypantsLatexDashes
+	}
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{Flags: flags})
+
+	return blackfriday.Run(source, blackfriday.WithRenderer(renderer))
+}
+
+func (r *HenryHTMLRenderer) Render(source []byte) []byte {
+	return source
+}
+
+func (r *HenryPlainRenderer) Render(source []byte) []byte {
+	return []byte("<pre>" + html.EscapeString(string(source)) + "</pre>")
+}
+
+func (r *HenryGoldmarkRenderer) Render(source []byte) []byte {
+	extensions := []goldmark.Extender{extension.GFM, extension.DefinitionList}
+	if r.Smartypants {
+		extensions = append(extensions, extension.Typographer)
+	}
+	md := goldmark.New(goldmark.WithExtensions(extensions...), goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()))
+
+	var buf bytes.Buffer
+	if err := md.Convert(source, &buf); err != nil {
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+func renderHenryDocumentHTML(doc *HenryDocument, site *HenrySite, tmpl *template.Template) (string, error) {
+	if tmpl == nil || tmpl.Lookup("page.html") == nil {
+		return "", errors.New(fmt.Sprintf("error rendering '%s': no template 'page.html'", doc.Path))
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "page.html", &HenryPageData{Site: site, Page: doc}); err != nil {
+		return "", errors.New(fmt.Sprintf("error rendering '%s': %s", doc.Path, err))
+	}
+
+	return buf.String(), nil
+}
+
+func (t *HenryLowercaseTags) Transform(metadata *HenryFileMetadata) {
+	for i, tag := range metadata.Tags {
+		metadata.Tags[i] = strings.ToLower(tag)
+	}
+}
+
+func RegisterMetadataTransformer(name string, transformer MetadataTransformer) {
+	henryMetadataTransformers[name] = transformer
+}
+
+func renderHenryFragment(nodes []*html.Node) (string, error) {
+	var buf bytes.Buffer
+
+	for _, node := range nodes {
+		if err := html.Render(&buf, node); err != nil {
+			return "", err
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func renderHenryGemtext(body string) string {
+	root := blackfriday.New(blackfriday.WithExtensions(blackfriday.CommonExtensions)).Parse([]byte(body))
+	lines := make([]string, 0)
+
+	var block func(node *blackfriday.Node, prefix string)
+	block = func(node *blackfriday.Node, prefix string) {
+		for child := node.FirstChild; child != nil; child = child.Next {
+			switch child.Type {
+			case blackfriday.Heading:
+				level := child.HeadingData.Level
+				if level > 3 {
+					level = 3
+				}
+				text, links := flattenHenryGemtext(child)
+				lines = append(lines, strings.Repeat("#", level)+" "+text, "")
+				lines = append(lines, links...)
+			case blackfriday.Paragraph:
+				text, links := flattenHenryGemtext(child)
+				lines = append(lines, prefix+text)
+				lines = append(lines, links...)
+				if prefix == "" {
+					lines = append(lines, "")
+				}
+			case blackfriday.Item:
+				for item := child.FirstChild; item != nil; item = item.Next {
+					if item.Type == blackfriday.List {
+						block(item, "")
+						continue
+					}
+					text, links := flattenHenryGemtext(item)
+					lines = append(lines, "* "+text)
+					lines = append(lines, links...)
+				}
+			case blackfriday.List:
+				block(child, "")
+				lines = append(lines, "")
+			case blackfriday.BlockQuote:
+				block(child, "> ")
+				lines = append(lines, "")
+			case blackfriday.CodeBlock:
+				lines = append(lines, "```", strings.TrimSuffix(string(child.Literal), "\n"), "```", "")
+			case blackfriday.Table:
+				block(child, "")
+				lines = append(lines, "")
+			case blackfriday.TableHead, blackfriday.TableBody:
+				block(child, "")
+			case blackfriday.TableRow:
+				cells := make([]string, 0)
+				for cell := child.FirstChild; cell != nil; cell = cell.Next {
+					text, _ := flattenHenryGemtext(cell)
+					cells = append(cells, text)
+				}
+				lines = append(lines, strings.Join(cells, " | "))
+			}
+		}
+	}
+	block(root, "")
+
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
+
+func rewriteHenryLinks(content string, opts RenderOptions) (string, error) {
+	nodes, err := parseHenryFragment(content)
+	if err != nil {
+		return "", err
+	}
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			for i, attr := range node.Attr {
+				if attr.Key != "href" && attr.Key != "src" {
+					continue
+				}
+
+				value := attr.Val
+				if opts.ResolveImages && node.DataAtom == atom.Img && attr.Key == "src" && isHenryRelativeURL(value) {
+					value = "/" + path.Join(opts.DocumentDir, value)
+				}
+
+				if opts.BasePath != "" && strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") &&
+					value != opts.BasePath && !strings.HasPrefix(value, opts.BasePath+"/") {
+					value = opts.BasePath + value
+				}
+
+				node.Attr[i].Val = value
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	for _, node := range nodes {
+		walk(node)
+	}
+
+	return renderHenryFragment(nodes)
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("henry", flag.ContinueOnError)
+	archive := flags.String("archive", "", "also pack the generated output into this .zip or .tar.gz file")
+	baseURL := flags.String("base-url", "", "override the configured baseURL")
+	configPath := flags.String("config", "henry.toml", "path to the configuration file")
+	cpuProfile := flags.String("cpuprofile", "", "write a CPU profile of the build to this file")
+	draftBanner := flags.Bool("draft-banner", false, "mark draft pages with a banner when building drafts")
+	drafts := flags.Bool("drafts", false, "build draft documents as well")
+	env := flags.String("env", "", "environment to build for (default: production)")
+	envFile := flags.String("env-file", "", "load variables from this file (default: .env if it exists)")
+	hooks := flags.Bool("hooks", false, "run the configured preBuild and postBuild commands")
+	jobs := flags.Int("jobs", 0, "number of files to process in parallel (default: number of CPUs)")
+	listScheduled := flags.Bool("list-scheduled", false, "list scheduled documents without building")
+	logFile := flags.String("log-file", "", "write log output to this file instead of stderr")
+	memProfile := flags.String("memprofile", "", "write a memory profile to this file after the build")
+	noDrafts := flags.Bool("no-drafts-allowed", false, "fail the build if any document is a draft")
+	noLock := flags.Bool("no-lock", false, "do not lock the output directory during the build")
+	outputFormat := flags.String("output-format", "", "write documents as html or gemini")
+	pretty := flags.Bool("pretty", false, "indent generated JSON and XML")
+	quiet := flags.Bool("quiet", false, "print nothing but errors")
+	var srcDirs HenryPathList
+	flags.Var(&srcDirs, "src", "content directory to build; repeat to merge several, later ones win")
+	since := flags.String("since", "", "only rewrite documents modified since this date (YYYY-MM-DD or RFC 3339)")
+	strict := flags.Bool("strict", false, "treat undefined variables and warnings as errors")
+	timings := flags.Bool("timings", false, "print how long each build phase took")
+	validateHTML := flags.Bool("validate-html", false, "check that every generated HTML file is well-formed")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return &HenryUsageError{Err: err}
+	}
+
+	henryLogger = log.New(os.Stderr, "", 0)
+	if *logFile != "" {
+		out, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return &HenryUsageError{Err: err}
+		}
+		defer out.Close()
+		henryLogger = log.New(out, "", log.LstdFlags|log.Lmicroseconds)
+	} else if *quiet {
+		henryLogger = log.New(ioutil.Discard, "", 0)
+	}
+
+	if !*listScheduled {
+		debug("%s v.0.1", os.Args[0])
+	}
+
+	if *archive != "" && !strings.HasSuffix(*archive, ".zip") && !strings.HasSuffix(*archive, ".tar.gz") && !strings.HasSuffix(*archive, ".tgz") {
+		return &HenryUsageError{Err: errors.New(fmt.Sprintf("invalid -archive value '%s': expected .zip, .tar.gz or .tgz", *archive))}
+	}
+
+	if *cpuProfile != "" {
+		stop, err := startHenryCPUProfile(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if *memProfile != "" {
+		defer writeHenryMemProfile(*memProfile)
+	}
+
+	if *envFile != "" {
+		if err := readHenryEnvFile(*envFile); err != nil {
+			return &HenryUsageError{Err: err}
+		}
+	} else if _, err := os.Stat(".env"); err == nil {
+		if err := readHenryEnvFile(".env"); err != nil {
+			return &HenryUsageError{Err: err}
+		}
+	}
+
+	config, err := readHenryConfig(*configPath, *strict)
+	if err != nil {
+		if _, ok := err.(*HenryStrictError); ok {
+			return err
+		}
+		return &HenryUsageError{Err: err}
+	}
+	if *baseURL != "" {
+		config.BaseURL = *baseURL
+	}
+	if *drafts {
+		config.BuildDrafts = true
+	}
+	if *env != "" {
+		config.Environment = *env
+	}
+	config.DraftBanner = *draftBanner && config.BuildDrafts
+	config.Quiet = *quiet
+	if *jobs > 0 {
+		config.Jobs = *jobs
+	}
+	if *outputFormat != "" {
+		if *outputFormat != "html" && *outputFormat != "gemini" {
+			return &HenryUsageError{Err: errors.New(fmt.Sprintf("invalid -output-format value '%s'", *outputFormat))}
+		}
+		config.OutputFormat = *outputFormat
+	}
+	if *pretty {
+		config.Pretty = true
+	}
+	if *since != "" {
+		sinceTime, err := parseHenryTime(*since)
+		if err != nil {
+			return &HenryUsageError{Err: errors.New(fmt.Sprintf("invalid -since value '%s'", *since))}
+		}
+		config.Since = sinceTime
+
+		cache, err := readHenryDocumentCache()
+		if err != nil {
+			debug("warning: %s", err.Error())
+		}
+		config.DocumentCache = cache
+	}
+
+	if *timings {
+		config.Timings = &HenryTimings{}
+	}
+
+	if *hooks && !*listScheduled {
+		if err := runHenryHook("preBuild", config.PreBuild); err != nil {
+			return err
+		}
+	}
+
+	if !*noLock && !*listScheduled {
+		lockPath, err := lockHenryOutput(config)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(lockPath)
+	}
+
+	if len(srcDirs) > 0 {
+		config.ContentDirs = srcDirs
+	}
+	rootPaths := config.ContentDirs
+	if len(rootPaths) == 0 {
+		rootPaths = []string{config.ContentDir}
+	}
+	rootPath := strings.Join(rootPaths, ", ")
+
+	tmpl, err := readHenryTemplates(config)
+	if err != nil {
+		return err
+	}
+
+	henryFiles, err := findHenrySourceFiles(rootPaths, config)
+	if err != nil {
+		return err
+	}
+
+	remoteFiles, err := fetchHenryRemoteFiles(config)
+	if err != nil {
+		return err
+	}
+	henryFiles = append(henryFiles, remoteFiles...)
+
+	start := time.Now()
+	henryDocs, err := createHenryDocuments(henryFiles, config)
+	if err != nil {
+		return err
+	}
+	config.Timings.Add("render", time.Since(start))
+	sortHenryDocuments(henryDocs, config.SortKey)
+
+	if err := markHenryContentAssets(henryFiles, henryDocs, config); err != nil {
+		return err
+	}
+
+	if *noDrafts {
+		paths := make([]string, 0)
+		for _, doc := range henryDocs {
+			if doc.Draft {
+				paths = append(paths, path.Join(doc.SubPath, doc.Name))
+			}
+		}
+		if len(paths) > 0 {
+			return &HenryStrictError{Err: errors.New(fmt.Sprintf("%d draft documents are not allowed: %s", len(paths), strings.Join(paths, ", ")))}
+		}
+	}
+
+	if config.FingerprintURLs {
+		if err := fingerprintHenryLinks(henryDocs); err != nil {
+			return err
+		}
+	}
+
+	scheduled := scheduledHenryDocuments(henryDocs, time.Now(), config.BuildDrafts)
+	if *listScheduled {
+		printHenryScheduled(os.Stdout, scheduled)
+		return nil
+	}
+
+	if len(henryDocs) == 0 {
+		if config.Strict {
+			return &HenryStrictError{Err: errors.New(fmt.Sprintf("no documents found under %s", rootPath))}
+		}
+		debug("warning: no documents found under %s", rootPath)
+	}
+
+	data, err := readHenryData(config.DataDir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	site := &HenrySite{
+		Title:       config.Title,
+		Description: config.Description,
+		Author:      config.Author,
+		BaseURL:     config.BaseURL,
+		Language:    config.Language,
+		Params:      config.Params,
+		Data:        data,
+		BuildTime:   now,
+		Documents:   make([]*HenryDocument, 0),
+		Sections:    make(map[string]*HenryDocument),
+	}
+	for _, henryDoc := range henryDocs {
+		if !isHenryDocumentPublished(henryDoc, now, config.BuildDrafts) || isHenryDocumentEmpty(henryDoc, config) {
+			continue
+		}
+
+		if henryDoc.IsSection {
+			site.Sections[henryDoc.SubPath] = henryDoc
+		} else {
+			site.Documents = append(site.Documents, henryDoc)
+		}
+	}
+	site.Recent = recentHenryDocuments(site.Documents, config.RecentCount, now, config.BuildDrafts)
+	site.Stats = countHenryDocuments(henryDocs, now, config.BuildDrafts)
+
+	config.OutputLog = &HenryOutputLog{}
+	start = time.Now()
+	if err := writeHenryDocuments(henryDocs, site, tmpl, config); err != nil {
+		return err
+	}
+	if !config.Since.IsZero() {
+		if err := writeHenryDocumentCache(henryDocs, config); err != nil {
+			return err
+		}
+	}
+	config.Timings.Add("write", time.Since(start))
+
+	start = time.Now()
+	if err := writeHenryTagIndexes(henryDocs, config); err != nil {
+		return err
+	}
+
+	pages := filterHenryEmpty(henryDocs, config)
+	if err := writeHenryArchive(pages, site, tmpl, config); err != nil {
+		return err
+	}
+
+	if err := writeHenryGenerators(site, tmpl, config); err != nil {
+		return err
+	}
+
+	if config.JSONFeed {
+		data, err := generateHenryJSONFeed(pages, now, config)
+		if err != nil {
+			return err
+		}
+		if err := writeHenryFile("feed.json", data, config); err != nil {
+			return err
+		}
+	}
+
+	if config.Sitemap {
+		if err := writeHenrySitemap(pages, now, config); err != nil {
+			return err
+		}
+	}
+	config.Timings.Add("indexes", time.Since(start))
+
+	start = time.Now()
+	if err := copyHenryStaticFiles(config); err != nil {
+		return err
+	}
+
+	if err := copyHenryContentAssets(henryFiles, config); err != nil {
+		return err
+	}
+	config.Timings.Add("static", time.Since(start))
+
+	if err := writeHenryRedirects(pages, config); err != nil {
+		return err
+	}
+
+	if *validateHTML {
+		if err := validateHenryOutput(config); err != nil {
+			return err
+		}
+	}
+
+	start = time.Now()
+	if err := writeHenryManifest(config); err != nil {
+		return err
+	}
+	config.Timings.Add("manifest", time.Since(start))
+
+	if *archive != "" {
+		if err := packHenryOutput(*archive, config); err != nil {
+			return err
+		}
+	}
+
+	debug("built %s documents, wrote %s files to %s", strconv.Itoa(len(henryDocs)), strconv.Itoa(len(config.OutputLog.Sorted())), config.OutputDir)
+
+	for _, doc := range scheduled {
+		debug("scheduled: %s %s", doc.Date.Format("2006-01-02 15:04"), doc.Path)
+	}
+
+	config.Timings.Print(os.Stdout)
+
+	if *hooks {
+		return runHenryHook("postBuild", config.PostBuild)
+	}
+
+	return nil
+}
+
+func runHenryHook(name string, command string) error {
+	if command == "" {
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("error running %s hook '%s': %s", name, command, err))
+	}
+
+	return nil
+}
+
+func runHenryJobs(count int, jobs int, job func(int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errs := make([]error, count)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = job(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scheduledHenryDocuments(docs []*HenryDocument, now time.Time, drafts bool) []*HenryDocument {
+	scheduled := make([]*HenryDocument, 0)
+
+	for _, doc := range docs {
+		if (drafts || !doc.Draft) && !isHenryDocumentPublished(doc, now, drafts) {
+			scheduled = append(scheduled, doc)
+		}
+	}
+
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		return scheduled[i].Date.Before(scheduled[j].Date)
+	})
+
+	return scheduled
+}
+
+func slugifyHenry(value string, config *HenryConfig) string {
+	value = strings.ToLower(value)
+	for from, to := range config.Slug.Replace {
+		if strings.ToLower(from) == value {
+			return to
+		}
+	}
+
+	if len(config.Slug.Transliterate) > 0 {
+		keys := make([]string, 0, len(config.Slug.Transliterate))
+		for from := range config.Slug.Transliterate {
+			keys = append(keys, from)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) > len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+
+		pairs := make([]string, 0, len(keys)*2)
+		for _, from := range keys {
+			pairs = append(pairs, strings.ToLower(from), config.Slug.Transliterate[from])
+		}
+		value = strings.NewReplacer(pairs...).Replace(value)
+	}
+
+	var buf bytes.Buffer
+	dash := false
+
+	for _, r := range value {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(config.Slug.Preserve, r) {
+			buf.WriteRune(r)
+			dash = false
+		} else if !dash && buf.Len() > 0 {
+			buf.WriteRune('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(buf.String(), "-")
+}
+
+func splitHenryFrontmatter(data string, custom string) (string, string, string, error) {
+	lines := strings.SplitAfter(data, "\n")
+
+	delimiter := strings.TrimSpace(lines[0])
+	if delimiter != "---" && delimiter != "+++" && (custom == "" || delimiter != custom) {
+		return "", "", data, nil
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == delimiter {
+			return delimiter, strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], ""), nil
+		}
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			return delimiter, strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], ""), nil
+		}
+	}
+
+	return "", "", "", errors.New("missing closing tag")
+}
+
+func sortHenryDocuments(docs []*HenryDocument, sortKey string) {
+	if sortKey != "date" && sortKey != "title" {
+		return
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		a, b := docs[i], docs[j]
+
+		titleA, titleB := strings.ToLower(a.Title), strings.ToLower(b.Title)
+		if sortKey == "title" && titleA != titleB {
+			return titleA < titleB
+		}
+		if !a.Date.Equal(b.Date) {
+			return a.Date.After(b.Date)
+		}
+		if titleA != titleB {
+			return titleA < titleB
+		}
+		if a.SubPath != b.SubPath {
+			return a.SubPath < b.SubPath
+		}
+		return a.Name < b.Name
+	})
+}
+
+func startHenryCPUProfile(path string) (func(), error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pprof.StartCPUProfile(out); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	return func() {
+		pprof.StopCPUProfile()
+		out.Close()
+	}, nil
+}
+
+func stripHenryTags(content string) (string, error) {
+	var buf bytes.Buffer
+
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return strings.TrimSpace(buf.String()), nil
+			}
+			return "", tokenizer.Err()
+		case html.TextToken:
+			buf.Write(tokenizer.Text())
+		}
+	}
+}
+
+func transformHenryMetadata(metadata *HenryFileMetadata, config *HenryConfig) {
+	for _, name := range config.Transform {
+		henryMetadataTransformers[name].Transform(metadata)
+	}
+}
+
+func truncateHenryText(text string, length int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= length {
+		return string(runes)
+	}
+
+	cut := string(runes[:length-1])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
+
+func unwrapHenryParagraph(content string) string {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "<p>") && strings.HasSuffix(content, "</p>") && strings.Count(content, "<p>") == 1 {
+		return strings.TrimSuffix(strings.TrimPrefix(content, "<p>"), "</p>")
+	}
+
+	return content
+}
+
+func validateHenryHTML(data []byte) error {
+	stack := make([]string, 0)
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return tokenizer.Err()
+			}
+			for i := len(stack) - 1; i >= 0; i-- {
+				if !henryOptionalEndElements[atom.Lookup([]byte(stack[i]))] {
+					return errors.New(fmt.Sprintf("unclosed <%s>", stack[i]))
+				}
+			}
+			return nil
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if !henryVoidElements[atom.Lookup(name)] {
+				stack = append(stack, string(name))
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			open := -1
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] == string(name) {
+					open = i
+					break
+				}
+			}
+			if open < 0 {
+				if henryVoidElements[atom.Lookup(name)] || henryOptionalEndElements[atom.Lookup(name)] {
+					continue
+				}
+				return errors.New(fmt.Sprintf("unexpected </%s>", name))
+			}
+			for i := len(stack) - 1; i > open; i-- {
+				if !henryOptionalEndElements[atom.Lookup([]byte(stack[i]))] {
+					return errors.New(fmt.Sprintf("unclosed <%s> before </%s>", stack[i], name))
+				}
+			}
+			stack = stack[:open]
+		}
+	}
+}
+
+func validateHenryOutput(config *HenryConfig) error {
+	invalid := make([]string, 0)
+
+	for _, rel := range config.OutputLog.Sorted() {
+		if path.Ext(rel) != ".html" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(config.OutputDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		if err := validateHenryHTML(data); err != nil {
+			debug("invalid html: %s: %s", rel, err.Error())
+			invalid = append(invalid, rel)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return errors.New(fmt.Sprintf("%d files have invalid html: %s", len(invalid), strings.Join(invalid, ", ")))
+	}
+
+	return nil
+}
+
+func writeHenryArchive(docs []*HenryDocument, site *HenrySite, tmpl *template.Template, config *HenryConfig) error {
+	if tmpl == nil || tmpl.Lookup("archive.html") == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	data := &HenryArchiveData{Site: site, Years: groupHenryDocumentsByMonth(filterHenryExcluded(docs, "archive"), site.BuildTime)}
+	if err := tmpl.ExecuteTemplate(&buf, "archive.html", data); err != nil {
+		return errors.New(fmt.Sprintf("error rendering 'archive/index.html': %s", err))
+	}
+
+	return writeHenryFile("archive/index.html", buf.Bytes(), config)
+}
+
+func writeHenryDocumentCache(docs []*HenryDocument, config *HenryConfig) error {
+	cache := make(HenryDocumentCache, len(docs))
+	for _, doc := range docs {
+		cache[doc.Source] = doc
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(henryCacheFile, data, henryFileMode(config))
+}
+
+func writeHenryDocuments(docs []*HenryDocument, site *HenrySite, tmpl *template.Template, config *HenryConfig) error {
+	for _, doc := range docs {
+		if !isHenryDocumentPublished(doc, site.BuildTime, config.BuildDrafts) {
+			continue
+		}
+
+		if rel := strings.TrimSuffix(doc.Path, ".html") + ".json"; doc.HasOutput("json") && !isHenryOutputCurrent(rel, doc, config) {
+			data, err := doc.JSON(config)
+			if err != nil {
+				return err
+			}
+			if err := writeHenryFile(rel, data, config); err != nil {
+				return err
+			}
+		}
+
+		if !doc.HasOutput("html") {
+			continue
+		}
+
+		if isHenryDocumentEmpty(doc, config) {
+			debug("warning: skipping %s: document has no body", doc.Path)
+			continue
+		}
+
+		if config.OutputFormat == "gemini" {
+			rel := strings.TrimSuffix(doc.Path, ".html") + ".gmi"
+			if isHenryOutputCurrent(rel, doc, config) {
+				continue
+			}
+			if err := writeHenryFile(rel, []byte(renderHenryGemtext(doc.ContentRaw)), config); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if isHenryOutputCurrent(doc.Path, doc, config) {
+			continue
+		}
+
+		content, err := renderHenryDocumentHTML(doc, site, tmpl)
+		if err != nil {
+			if config.Strict {
+				return &HenryStrictError{Err: err}
+			}
+			return err
+		}
+		data := []byte(content)
+
+		if doc.Draft && config.DraftBanner {
+			data = injectHenryDraftBanner(data)
+		}
+
+		if config.NormalizeHTML {
+			normalized, err := normalizeHenryHTML(data)
+			if err != nil {
+				return errors.New(fmt.Sprintf("error normalizing '%s': %s", doc.Path, err))
+			}
+			data = normalized
+		}
+
+		if err := writeHenryFile(doc.Path, data, config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeHenryFile(rel string, data []byte, config *HenryConfig) error {
+	path := filepath.Join(config.OutputDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), henryDirMode(config)); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, data, henryFileMode(config)); err != nil {
+		return err
+	}
+	config.OutputLog.Record(rel)
+
+	return os.Chmod(path, henryFileMode(config))
+}
+
+func writeHenryGenerators(site *HenrySite, tmpl *template.Template, config *HenryConfig) error {
+	if len(config.Generators) == 0 {
+		return nil
+	}
+
+	for _, generator := range config.Generators {
+		if tmpl == nil || tmpl.Lookup(generator.Template) == nil {
+			return errors.New(fmt.Sprintf("error running generator: no template '%s'", generator.Template))
+		}
+
+		records, err := henryGeneratorRecords(site.Data, generator.Data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("error running generator '%s': %s", generator.Template, err))
+		}
+
+		for _, record := range records {
+			rel, err := henryGeneratorPath(generator.Path, record, config)
+			if err != nil {
+				return errors.New(fmt.Sprintf("error running generator '%s': %s", generator.Template, err))
+			}
+
+			var buf bytes.Buffer
+			if err := tmpl.ExecuteTemplate(&buf, generator.Template, &HenryGeneratorData{Site: site, Record: record}); err != nil {
+				return errors.New(fmt.Sprintf("error rendering '%s': %s", rel, err))
+			}
+			if err := writeHenryFile(rel, buf.Bytes(), config); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
+
+func writeHenryManifest(config *HenryConfig) error {
+	if config.Manifest == "" || config.OutputLog == nil {
+		return nil
+	}
+
+	entries := make([]HenryManifestEntry, 0)
+	for _, rel := range config.OutputLog.Sorted() {
+		data, err := ioutil.ReadFile(filepath.Join(config.OutputDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		entries = append(entries, HenryManifestEntry{Path: rel, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	if config.Manifest == "sums" {
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			fmt.Fprintf(&buf, "%s  %s\n", entry.SHA256, entry.Path)
+		}
+		return writeHenryFile("SHA256SUMS", buf.Bytes(), config)
+	}
+
+	data, err := marshalHenryJSON(entries, config)
+	if err != nil {
+		return err
+	}
+
+	return writeHenryFile("manifest.json", data, config)
+}
+
+func writeHenryMemProfile(path string) {
+	out, err := os.Create(path)
+	if err != nil {
+		debug("warning: could not write memory profile: %s", err.Error())
+		return
+	}
+	defer out.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(out); err != nil {
+		debug("warning: could not write memory profile: %s", err.Error())
+	}
+}
+
+func writeHenryRedirects(docs []*HenryDocument, config *HenryConfig) error {
+	redirects, err := readHenryRedirects(config.RedirectsFile)
+	if err != nil || len(redirects) == 0 {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, doc := range docs {
+		known[doc.URL] = true
+	}
+	if config.OutputLog != nil {
+		for _, rel := range config.OutputLog.Sorted() {
+			known["/"+rel] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, redirect := range redirects {
+		u, err := url.Parse(redirect.To)
+		if err != nil || (u.Scheme == "" && !known[u.Path]) {
+			return errors.New(fmt.Sprintf("error parsing redirects '%s': unknown target '%s'", config.RedirectsFile, redirect.To))
+		}
+
+		fmt.Fprintf(&buf, "%s %s %d\n", redirect.From, redirect.To, redirect.Status)
+
+		if config.RedirectPages {
+			rel := path.Clean(strings.TrimPrefix(redirect.From, "/"))
+			if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+				return errors.New(fmt.Sprintf("error parsing redirects '%s': '%s' is outside the output directory", config.RedirectsFile, redirect.From))
+			}
+			if path.Ext(rel) != ".html" {
+				rel = path.Join(rel, "index.html")
+			}
+
+			target := template.HTMLEscapeString(redirect.To)
+			page := fmt.Sprintf("<!doctype html><html><head><meta http-equiv=\"refresh\" content=\"0; url=%s\"><link rel=\"canonical\" href=\"%s\"></head></html>\n", target, target)
+			if err := writeHenryFile(rel, []byte(page), config); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeHenryFile("_redirects", buf.Bytes(), config)
+}
+
+func writeHenrySitemap(docs []*HenryDocument, now time.Time, config *HenryConfig) error {
+	urls := make([]HenrySitemapURL, 0, len(docs))
+	for _, doc := range filterHenryExcluded(docs, "sitemap") {
+		if !isHenryDocumentPublished(doc, now, config.BuildDrafts) || doc.NoIndex || !doc.HasOutput("html") {
+			continue
+		}
+		urls = append(urls, HenrySitemapURL{
+			Loc:     henryAbsoluteURL(doc.URL, config),
+			LastMod: doc.LastMod.Format("2006-01-02"),
+		})
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].Loc < urls[j].Loc
+	})
+
+	const xmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+	limit := config.SitemapLimit
+	if limit <= 0 || len(urls) <= limit {
+		data, err := marshalHenryXML(HenrySitemap{Xmlns: xmlns, URLs: urls}, config)
+		if err != nil {
+			return err
+		}
+		return writeHenryFile("sitemap.xml", data, config)
+	}
+
+	index := HenrySitemapIndex{Xmlns: xmlns}
+	for start := 0; start < len(urls); start += limit {
+		end := start + limit
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		name := fmt.Sprintf("sitemap-%d.xml", len(index.Sitemaps)+1)
+		data, err := marshalHenryXML(HenrySitemap{Xmlns: xmlns, URLs: urls[start:end]}, config)
+		if err != nil {
+			return err
+		}
+		if err := writeHenryFile(name, data, config); err != nil {
+			return err
+		}
+
+		index.Sitemaps = append(index.Sitemaps, HenrySitemapEntry{
+			Loc: henryAbsoluteURL(henryBasePath(config)+"/"+name, config),
+		})
+	}
+
+	data, err := marshalHenryXML(index, config)
+	if err != nil {
+		return err
+	}
+
+	return writeHenryFile("sitemap_index.xml", data, config)
+}
+
+func writeHenryTagIndexes(docs []*HenryDocument, config *HenryConfig) error {
+	groups := groupHenryDocumentsByTag(filterHenryExcluded(docs, "tags"), time.Now(), config.BuildDrafts)
+
+	tags := make([]string, 0, len(groups))
+	for tag := range groups {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	indexes := make([]HenryTagIndex, 0, len(tags))
+	for _, tag := range tags {
+		slug := slugifyHenry(tag, config)
+
+		entries := make([]HenryTagEntry, 0, len(groups[tag]))
+		for _, doc := range groups[tag] {
+			if doc.Excludes("search") {
+				continue
+			}
+			entries = append(entries, HenryTagEntry{
+				Title:   doc.Title,
+				URL:     doc.LinkURL,
+				Date:    doc.Date.Format(time.RFC3339),
+				Summary: doc.FeedSummary(),
+				Params:  henryPublicParams(doc.Params, config),
+			})
+		}
+
+		data, err := marshalHenryJSON(entries, config)
+		if err != nil {
+			return err
+		}
+		if err := writeHenryFile(path.Join("tags", slug, "index.json"), data, config); err != nil {
+			return err
+		}
+
+		index := HenryTagIndex{
+			Name:  tag,
+			Slug:  slug,
+			URL:   henryBasePath(config) + "/" + path.Join("tags", slug, "index.json"),
+			Count: len(groups[tag]),
+		}
+
+		if config.TagFeeds {
+			feed, err := generateHenryTagFeed(tag, filterHenryEmpty(groups[tag], config), config)
+			if err != nil {
+				return err
+			}
+			if err := writeHenryFile(path.Join("tags", slug, "rss.xml"), feed, config); err != nil {
+				return err
+			}
+			index.Feed = henryBasePath(config) + "/" + path.Join("tags", slug, "rss.xml")
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	data, err := marshalHenryJSON(indexes, config)
+	if err != nil {
+		return err
+	}
+
+	return writeHenryFile(path.Join("tags", "index.json"), data, config)
+}
@@ -0,0 +1,2310 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// writeTestSite writes files, keyed by slash-separated path, into a fresh
+// temporary directory and makes it the working directory for the test.
+func writeTestSite(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return dir
+}
+
+// buildTestSite writes a site with writeTestSite and builds it with args.
+func buildTestSite(t *testing.T, files map[string]string, args ...string) string {
+	t.Helper()
+
+	dir := writeTestSite(t, files)
+	if err := run(append([]string{"-quiet"}, args...)); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	return dir
+}
+
+// readTestFile returns the contents of a file relative to the working directory.
+func readTestFile(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func testConfig(t *testing.T) *HenryConfig {
+	t.Helper()
+
+	config, err := readHenryConfig(filepath.Join(t.TempDir(), "henry.toml"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+// readTestTree returns every file under dir keyed by its slash-separated path.
+func readTestTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = readTestFile(t, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestContentParagraphs(t *testing.T) {
+	content, err := RenderMarkdown("# Title\n\nFirst.\n\n- one\n- two\n\n## More\n\nSecond *one*.\n", RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paragraphs, err := findHenryParagraphs(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"<p>First.</p>", "<p>Second <em>one</em>.</p>"}
+	if !reflect.DeepEqual(paragraphs, want) {
+		t.Errorf("got %q, want %q", paragraphs, want)
+	}
+}
+
+func TestConfigExpandsEnvironment(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml": "title = \"${HENRY_TEST_FOO}\"\nbaseURL = \"https://${HENRY_TEST_UNSET}example.com\"\n\n[params]\nowner = \"${HENRY_TEST_FOO}\"\n",
+	})
+	t.Setenv("HENRY_TEST_FOO", "bar")
+	os.Unsetenv("HENRY_TEST_UNSET")
+
+	config, err := readHenryConfig("henry.toml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Title != "bar" {
+		t.Errorf("title = %q, want %q", config.Title, "bar")
+	}
+	if config.Params["owner"] != "bar" {
+		t.Errorf("params.owner = %q, want %q", config.Params["owner"], "bar")
+	}
+	if config.BaseURL != "https://example.com" {
+		t.Errorf("baseURL = %q, want %q", config.BaseURL, "https://example.com")
+	}
+
+	if _, err := readHenryConfig("henry.toml", true); err == nil {
+		t.Error("expected an error for an unset variable under strict")
+	}
+}
+
+func TestFrontmatterExpandsEnvironment(t *testing.T) {
+	t.Setenv("HENRY_TEST_FOO", "bar")
+
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Title }}|{{ .Page.Author }}|{{ range .Page.Tags }}{{ . }}{{ end }}",
+		"content/a.md":        "---\ntitle: Save $5 on $HOME plans\nauthor: ${HENRY_TEST_FOO}\ntags: [\"${HENRY_TEST_FOO}\"]\nsummary: Costs $10\n---\nA.\n",
+	}, "-strict")
+
+	if got, want := readTestFile(t, "public/a.html"), "Save $5 on $HOME plans|bar|bar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLD(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":       "title = \"Site\"\nauthor = \"Site Author\"\n",
+		"content/hello.md": "---\ntitle: Hello </script>\ndate: 2021-02-03T04:05:06Z\ndescription: A greeting.\n---\nHi.\n",
+	})
+
+	page := readTestFile(t, "public/hello.html")
+	start := strings.Index(page, `<script type="application/ld+json">`)
+	end := strings.Index(page[start:], "</script>")
+	if start < 0 || end < 0 {
+		t.Fatalf("no JSON-LD script in %q", page)
+	}
+	raw := page[start+len(`<script type="application/ld+json">`) : start+end]
+
+	var article HenryJSONLDArticle
+	if err := json.Unmarshal([]byte(raw), &article); err != nil {
+		t.Fatalf("invalid JSON-LD %q: %s", raw, err)
+	}
+	want := HenryJSONLDArticle{
+		Context:       "https://schema.org",
+		Type:          "Article",
+		Headline:      "Hello </script>",
+		DatePublished: "2021-02-03T04:05:06Z",
+		DateModified:  article.DateModified,
+		Author:        &HenryJSONLDPerson{Type: "Person", Name: "Site Author"},
+		Description:   "A greeting.",
+	}
+	if !reflect.DeepEqual(article, want) {
+		t.Errorf("got %+v, want %+v", article, want)
+	}
+
+	data, err := (&HenryDocument{Title: "</script>"}).JSONLD(&HenryConfig{Author: "Config Author"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "</script>") || !strings.Contains(data, `"name":"Config Author"`) {
+		t.Errorf("JSONLD(config) = %q", data)
+	}
+}
+
+func TestPrettyOutput(t *testing.T) {
+	value := []HenryTagIndex{{Name: "go", Slug: "go", URL: "/tags/go/index.json", Count: 2}}
+
+	compact, err := marshalHenryJSON(value, &HenryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pretty, err := marshalHenryJSON(value, &HenryConfig{Pretty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(compact), "\n") {
+		t.Errorf("compact output has newlines: %q", compact)
+	}
+	if !strings.Contains(string(pretty), "\n  ") {
+		t.Errorf("pretty output is not indented: %q", pretty)
+	}
+
+	var a, b []HenryTagIndex
+	if err := json.Unmarshal(compact, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(pretty, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("compact %+v and pretty %+v differ", a, b)
+	}
+
+	sitemap := HenrySitemap{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: []HenrySitemapURL{{Loc: "https://example.com/"}}}
+	compactXML, err := marshalHenryXML(sitemap, &HenryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prettyXML, err := marshalHenryXML(sitemap, &HenryConfig{Pretty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(compactXML), "\n") {
+		t.Errorf("compact XML has newlines: %q", compactXML)
+	}
+	if !strings.Contains(string(prettyXML), "\n  <url>") {
+		t.Errorf("pretty XML is not indented: %q", prettyXML)
+	}
+}
+
+func TestNoIndex(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":        "baseURL = \"https://example.com\"\nsitemap = true\njsonFeed = true\n",
+		"content/public.md": "---\ntags: [go]\n---\nPublic.\n",
+		"content/hidden.md": "---\nnoindex: true\ntags: [go]\n---\nHidden.\n",
+	})
+
+	if page := readTestFile(t, "public/hidden.html"); !strings.Contains(page, `<meta name="robots" content="noindex">`) {
+		t.Errorf("hidden page has no robots meta: %q", page)
+	}
+	for _, name := range []string{"public/sitemap.xml", "public/feed.json", "public/tags/go/index.json"} {
+		index := readTestFile(t, name)
+		if !strings.Contains(index, "public.html") {
+			t.Errorf("%s does not list public.html", name)
+		}
+		if strings.Contains(index, "hidden.html") {
+			t.Errorf("%s lists hidden.html", name)
+		}
+	}
+}
+
+func TestEmptySourceTree(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml": "sitemap = true\njsonFeed = true\n",
+	})
+	if err := os.Mkdir("content", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"-log-file", "build.log"}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if log := readTestFile(t, "build.log"); !strings.Contains(log, "warning: no documents found under content") {
+		t.Errorf("no warning in log: %q", log)
+	}
+
+	var sitemap HenrySitemap
+	if err := xml.Unmarshal([]byte(readTestFile(t, "public/sitemap.xml")), &sitemap); err != nil {
+		t.Fatalf("invalid sitemap: %s", err)
+	}
+	if len(sitemap.URLs) != 0 {
+		t.Errorf("sitemap has %d urls, want 0", len(sitemap.URLs))
+	}
+
+	var feed HenryJSONFeed
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/feed.json")), &feed); err != nil {
+		t.Fatalf("invalid feed: %s", err)
+	}
+	if len(feed.Items) != 0 {
+		t.Errorf("feed has %d items, want 0", len(feed.Items))
+	}
+
+	err := run([]string{"-quiet", "-strict"})
+	if _, ok := err.(*HenryStrictError); !ok {
+		t.Errorf("strict build returned %v, want a HenryStrictError", err)
+	}
+}
+
+func TestHeadingOffset(t *testing.T) {
+	content, err := RenderMarkdown("# Title\n\n###### Deep\n", RenderOptions{HeadingOffset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(content, "<h2>Title</h2>") {
+		t.Errorf("# Title was not demoted to h2: %q", content)
+	}
+	if !strings.Contains(content, "<h6>Deep</h6>") {
+		t.Errorf("###### Deep did not stay h6: %q", content)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		code  int
+	}{
+		{"success", map[string]string{"content/a.md": "A.\n"}, nil, HenryExitSuccess},
+		{"build", map[string]string{"content/a.md": "A.\n", "templates/page.html": "{{ .Page.Title "}, nil, HenryExitBuildError},
+		{"usage", map[string]string{"content/a.md": "A.\n"}, []string{"-no-such-flag"}, HenryExitUsageError},
+		{"config", map[string]string{"henry.toml": "sortKey = \"size\"\n"}, nil, HenryExitUsageError},
+		{"strict", map[string]string{"content/a.md": "---\ntitle: ${HENRY_TEST_UNSET}\n---\nA.\n"}, []string{"-strict"}, HenryExitStrictError},
+	}
+
+	os.Unsetenv("HENRY_TEST_UNSET")
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTestSite(t, test.files)
+			err := run(append([]string{"-quiet"}, test.args...))
+			if code := henryExitCode(err); code != test.code {
+				t.Errorf("exit code %d (%v), want %d", code, err, test.code)
+			}
+		})
+	}
+}
+
+func TestDraftFileNames(t *testing.T) {
+	config := testConfig(t)
+	root := "content"
+
+	wip := &HenryFile{Name: "_wip.md", Path: filepath.Join("content", "posts", "_wip.md")}
+	if err := classifyHenryFile(wip, &root, config); err != nil {
+		t.Fatal(err)
+	}
+	if !wip.Draft || wip.IsSection {
+		t.Errorf("_wip.md: draft %v, section %v; want a draft", wip.Draft, wip.IsSection)
+	}
+
+	index := &HenryFile{Name: "_index.md", Path: filepath.Join("content", "posts", "_index.md")}
+	if err := classifyHenryFile(index, &root, config); err != nil {
+		t.Fatal(err)
+	}
+	if index.Draft || !index.IsSection {
+		t.Errorf("_index.md: draft %v, section %v; want a section", index.Draft, index.IsSection)
+	}
+}
+
+func TestRenderMarkdownOptions(t *testing.T) {
+	source := "# Hello\n\nSome *text* and <span class=\"x\">html</span>.\n"
+
+	content, err := RenderMarkdown(source, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(content, "<em>text</em>") || !strings.Contains(content, "<h1>Hello</h1>") {
+		t.Errorf("default render: %q", content)
+	}
+
+	content, err = RenderMarkdown(source, RenderOptions{Policy: bluemonday.StrictPolicy()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(content, "<") {
+		t.Errorf("strict policy left tags: %q", content)
+	}
+
+	content, err = RenderMarkdown(source, RenderOptions{HeadingAnchors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(content, `<h1 id="hello">Hello <a href="#hello" class="anchor">#</a></h1>`) {
+		t.Errorf("heading anchors: %q", content)
+	}
+}
+
+func TestDocumentID(t *testing.T) {
+	a := &HenryFile{Name: "hello.md", SubPath: "/posts/"}
+	b := &HenryFile{Name: "hello.md", SubPath: "/posts/", Body: "changed"}
+	c := &HenryFile{Name: "world.md", SubPath: "/posts/"}
+
+	if henryDocumentID(a) != henryDocumentID(b) {
+		t.Errorf("same file gave ids %s and %s", henryDocumentID(a), henryDocumentID(b))
+	}
+	if henryDocumentID(a) == henryDocumentID(c) {
+		t.Errorf("different files share id %s", henryDocumentID(a))
+	}
+}
+
+func TestMathPassthrough(t *testing.T) {
+	content, err := RenderMarkdown("Inline $a^2$ and *emphasis* and $$x_1 * y_2$$.\n", RenderOptions{Math: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"$a^2$", "$$x_1 * y_2$$", "<em>emphasis</em>"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("%q not in %q", want, content)
+		}
+	}
+}
+
+func TestSinceUsesCache(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":          "jsonFeed = true\n",
+		"templates/page.html": "{{ .Page.Title }}",
+		"content/old.md":      "---\ntitle: Old\n---\nOld.\n",
+		"content/new.md":      "---\ntitle: New\n---\nNew.\n",
+	})
+	old := time.Now().AddDate(-1, 0, 0)
+	if err := os.Chtimes(filepath.Join("content", "old.md"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	if err := run([]string{"-quiet", "-since", since}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	// Change old.md without touching its modification time: the second
+	// build must take it from the cache instead of rendering it again.
+	if err := ioutil.WriteFile(filepath.Join("content", "old.md"), []byte("---\ntitle: Changed\n---\nChanged.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join("content", "old.md"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-quiet", "-since", since}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if got := readTestFile(t, "public/old.html"); got != "Old" {
+		t.Errorf("old.html = %q, want the first build", got)
+	}
+	var feed HenryJSONFeed
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/feed.json")), &feed); err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, 0, len(feed.Items))
+	for _, item := range feed.Items {
+		titles = append(titles, item.Title)
+	}
+	sort.Strings(titles)
+	if want := []string{"New", "Old"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("feed titles = %q, want %q", titles, want)
+	}
+	if _, err := os.Stat(filepath.Join("public", henryCacheFile)); err == nil {
+		t.Error("the cache was written to the output directory")
+	}
+}
+
+func TestStaticAndContentDirs(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/page.md":    "# Page\n",
+		"static/raw.md":      "# Raw\n",
+		"static/css/a.css":   "body {}\n",
+		"content/posts/b.md": "B.\n",
+	})
+
+	if got := readTestFile(t, "public/raw.md"); got != "# Raw\n" {
+		t.Errorf("static raw.md = %q, want it copied as-is", got)
+	}
+	if got := readTestFile(t, "public/css/a.css"); got != "body {}\n" {
+		t.Errorf("static css = %q", got)
+	}
+	if got := readTestFile(t, "public/page.html"); !strings.Contains(got, "<h1>Page</h1>") {
+		t.Errorf("content page.md was not rendered: %q", got)
+	}
+	readTestFile(t, "public/posts/b.html")
+
+	for _, name := range []string{"public/raw.html", "public/page.md", "public/posts/b.md"} {
+		if _, err := os.Stat(filepath.FromSlash(name)); err == nil {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":      "sitemap = true\nmanifest = \"json\"\n",
+		"content/old.md":  "Old.\n",
+		"content/new.md":  "New.\n",
+		"public/old.html": "stale",
+		"public/new.html": "stale",
+	})
+	old := time.Now().AddDate(-1, 0, 0)
+	if err := os.Chtimes(filepath.Join("content", "old.md"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"-quiet", "-since", time.Now().AddDate(0, 0, -1).Format("2006-01-02")}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if page := readTestFile(t, "public/old.html"); page != "stale" {
+		t.Errorf("old.html was rewritten: %q", page)
+	}
+	if page := readTestFile(t, "public/new.html"); !strings.Contains(page, "New.") {
+		t.Errorf("new.html was not rebuilt: %q", page)
+	}
+	for _, name := range []string{"public/sitemap.xml", "public/manifest.json"} {
+		index := readTestFile(t, name)
+		if !strings.Contains(index, "old.html") || !strings.Contains(index, "new.html") {
+			t.Errorf("%s does not list both documents: %q", name, index)
+		}
+	}
+}
+
+func TestNotFoundPage(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":       "baseURL = \"https://example.com\"\nsitemap = true\n",
+		"content/404.md":   "Nothing here.\n",
+		"content/index.md": "Home.\n",
+	})
+
+	if page := readTestFile(t, "public/404.html"); !strings.Contains(page, "Nothing here.") {
+		t.Errorf("404.html: %q", page)
+	}
+	if sitemap := readTestFile(t, "public/sitemap.xml"); strings.Contains(sitemap, "404") {
+		t.Errorf("sitemap lists the 404 page: %q", sitemap)
+	}
+}
+
+func TestSummaryFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"block", "<p>Some <em>emphasis</em> here.</p>"},
+		{"inline", "Some <em>emphasis</em> here."},
+		{"plain", "Some emphasis here."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			buildTestSite(t, map[string]string{
+				"henry.toml":          fmt.Sprintf("summaryFormat = %q\n", test.format),
+				"templates/page.html": "{{ safeHTML .Page.Summary }}",
+				"content/a.md":        "Some *emphasis* here.\n\nMore.\n",
+			})
+
+			if got := readTestFile(t, "public/a.html"); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildLock(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"content/a.md":       "A.\n",
+		"public/.henry.lock": "1\n",
+	})
+
+	err := run([]string{"-quiet"})
+	if err == nil || !strings.Contains(err.Error(), "is locked by another build") {
+		t.Errorf("run returned %v, want a lock error", err)
+	}
+	if _, err := os.Stat(filepath.Join("public", "a.html")); err == nil {
+		t.Error("a locked build wrote output")
+	}
+
+	if err := run([]string{"-quiet", "-no-lock"}); err != nil {
+		t.Errorf("run -no-lock: %s", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	config := testConfig(t)
+	config.OutputDir = t.TempDir()
+	config.FileMode = "0600"
+	lockPath, err := lockHenryOutput(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0600 {
+		t.Errorf("lock file has mode %s, want %s", info.Mode(), os.FileMode(0600))
+	}
+}
+
+func TestSortKeyNone(t *testing.T) {
+	docs := []*HenryDocument{
+		{Name: "c.md", Title: "C", Date: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "a.md", Title: "A", Date: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "b.md", Title: "B", Date: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	names := func() []string {
+		names := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			names = append(names, doc.Name)
+		}
+		return names
+	}
+
+	sortHenryDocuments(docs, "none")
+	if got, want := names(), []string{"c.md", "a.md", "b.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("none: got %q, want %q", got, want)
+	}
+
+	sortHenryDocuments(docs, "date")
+	if got, want := names(), []string{"a.md", "b.md", "c.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("date: got %q, want %q", got, want)
+	}
+}
+
+func TestSiteData(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"data/menu.toml":      "[[items]]\nname = \"Home\"\n\n[[items]]\nname = \"About\"\n",
+		"templates/page.html": "{{ range .Site.Data.menu.items }}{{ .name }} {{ end }}",
+		"content/a.md":        "A.\n",
+	})
+
+	if got := readTestFile(t, "public/a.html"); got != "Home About " {
+		t.Errorf("got %q, want %q", got, "Home About ")
+	}
+}
+
+func TestTitleFromFileName(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html":      "{{ .Page.Title }}",
+		"content/my-first-post.md": "Hello.\n",
+	})
+
+	if got := readTestFile(t, "public/my-first-post.html"); got != "My First Post" {
+		t.Errorf("got %q, want %q", got, "My First Post")
+	}
+}
+
+func TestTitleDropsExtension(t *testing.T) {
+	if got := humanizeHenryName("about.md"); got != "About" {
+		t.Errorf("got %q, want %q", got, "About")
+	}
+}
+
+func TestJobsOutputIsIdentical(t *testing.T) {
+	files := map[string]string{
+		"henry.toml": "baseURL = \"https://example.com\"\nsitemap = true\njsonFeed = true\n",
+	}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("content/posts/post-%02d.md", i)] = fmt.Sprintf("---\ndate: 2020-01-%02d\ntags: [t%d]\n---\nPost %d.\n", i+1, i%3, i)
+	}
+	buildTestSite(t, files)
+	parallel := readTestTree(t, "public")
+
+	if err := os.RemoveAll("public"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-quiet", "-jobs", "1"}); err != nil {
+		t.Fatalf("run -jobs 1: %s", err)
+	}
+	serial := readTestTree(t, "public")
+
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Error("-jobs 1 output differs from the parallel build")
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/a.md": "---\ntitle: A\ntags: [go, web]\n---\nA.\n",
+		"content/b.md": "---\ntitle: B\ntags: [go]\n---\nB.\n",
+		"content/c.md": "---\ntitle: C\ntags: [web]\n---\nC.\n",
+	})
+
+	var entries []HenryTagEntry
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/go/index.json")), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	titles := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		titles = append(titles, entry.Title)
+	}
+	sort.Strings(titles)
+	if want := []string{"A", "B"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("got %q, want %q", titles, want)
+	}
+}
+
+func TestBasePathLinks(t *testing.T) {
+	content, err := RenderMarkdown("[About](/about/) and [X](https://x/) and [Home](/blog/).\n", RenderOptions{BasePath: "/blog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`href="/blog/about/"`, `href="https://x/"`, `href="/blog/"`} {
+		if !strings.Contains(content, want) {
+			t.Errorf("%s not in %q", want, content)
+		}
+	}
+}
+
+func TestTagIndexBasePath(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":   "baseURL = \"https://example.com/blog/\"\n",
+		"content/a.md": "---\ntitle: A\ntags: [go]\n---\nA.\n",
+	})
+
+	var indexes []HenryTagIndex
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/index.json")), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].URL != "/blog/tags/go/index.json" {
+		t.Errorf("got %+v, want the URL under /blog", indexes)
+	}
+
+	var entries []HenryTagEntry
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/go/index.json")), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].URL != "/blog/a.html" {
+		t.Errorf("got %+v, want /blog/a.html", entries)
+	}
+}
+
+func TestFrontmatterFormats(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Title }}|{{ range .Page.Tags }}{{ . }}{{ end }}",
+		"content/toml.md":     "+++\ntitle = \"From TOML\"\ntags = [\"a\"]\n+++\nBody.\n",
+		"content/yaml.md":     "---\ntitle: From YAML\ntags: [b]\n---\nBody.\n",
+	})
+
+	if got := readTestFile(t, "public/toml.html"); got != "From TOML|a" {
+		t.Errorf("toml: got %q", got)
+	}
+	if got := readTestFile(t, "public/yaml.html"); got != "From YAML|b" {
+		t.Errorf("yaml: got %q", got)
+	}
+}
+
+func TestSiteAndPageTitles(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "title = \"My Site\"\n",
+		"templates/page.html": "{{ .Page.Title }} - {{ .Site.Title }}",
+		"content/a.md":        "---\ntitle: A Page\n---\nA.\n",
+	})
+
+	if got := readTestFile(t, "public/a.html"); got != "A Page - My Site" {
+		t.Errorf("got %q, want %q", got, "A Page - My Site")
+	}
+}
+
+func TestSiteRecent(t *testing.T) {
+	files := map[string]string{
+		"henry.toml":                "title = \"Recent\"\n",
+		"templates/page.html":       "{{ range .Site.Recent }}{{ .Name }} {{ end }}",
+		"content/posts/_index.md":   "---\ntitle: Posts\n---\n",
+		"content/posts/zz-late.md":  "---\ndate: 2020-01-09\n---\nLate.\n",
+		"content/posts/aa-early.md": "---\ndate: 2020-01-01\n---\nEarly.\n",
+	}
+	for i := 2; i <= 7; i++ {
+		files[fmt.Sprintf("content/posts/post-%d.md", i)] = fmt.Sprintf("---\ndate: 2020-01-0%d\n---\nPost %d.\n", i, i)
+	}
+	buildTestSite(t, files)
+
+	got := strings.Fields(readTestFile(t, "public/posts/aa-early.html"))
+	want := []string{"zz-late.md", "post-7.md", "post-6.md", "post-5.md", "post-4.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStrictTemplates(t *testing.T) {
+	files := map[string]string{
+		"templates/page.html": "[{{ .Site.Params.color }}]",
+		"content/a.md":        "A.\n",
+	}
+
+	buildTestSite(t, files)
+	if got := readTestFile(t, "public/a.html"); got != "[]" {
+		t.Errorf("got %q, want %q", got, "[]")
+	}
+
+	err := run([]string{"-quiet", "-strict"})
+	if _, ok := err.(*HenryStrictError); !ok {
+		t.Errorf("strict build returned %v, want a HenryStrictError", err)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		pretty bool
+		slash  string
+		want   string
+	}{
+		{true, "add", "/posts/a/"},
+		{true, "remove", "/posts/a"},
+		{false, "add", "/posts/a.html"},
+		{false, "remove", "/posts/a.html"},
+	}
+
+	for _, test := range tests {
+		config := &HenryConfig{PrettyURLs: test.pretty, TrailingSlash: test.slash}
+		file := &HenryFile{Name: "a.md", SubPath: "/posts/"}
+		doc := &HenryDocument{Path: henryDocumentPath(file, config)}
+
+		if got := henryDocumentURL(doc, config); got != test.want {
+			t.Errorf("prettyURLs %v, trailingSlash %s: got %q, want %q", test.pretty, test.slash, got, test.want)
+		}
+	}
+
+	section := &HenryDocument{Path: "posts/index.html"}
+	if got := henryDocumentURL(section, &HenryConfig{TrailingSlash: "remove"}); got != "/posts" {
+		t.Errorf("section with remove: got %q, want %q", got, "/posts")
+	}
+	if got := henryDocumentURL(&HenryDocument{Path: "index.html"}, &HenryConfig{TrailingSlash: "remove"}); got != "/" {
+		t.Errorf("root with remove: got %q, want %q", got, "/")
+	}
+}
+
+func TestGitInfo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	writeTestSite(t, map[string]string{
+		"henry.toml":   "gitInfo = true\n",
+		"content/a.md": "A.\n",
+	})
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Add a"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Skipf("git %s: %s: %s", args[0], err, out)
+		}
+	}
+
+	info := readHenryGitInfo(filepath.Join("content", "a.md"))
+	if info == nil {
+		t.Fatal("no git info for a committed file")
+	}
+	if len(info.Hash) != 40 || info.AbbreviatedHash != info.Hash[:7] || info.Date.IsZero() {
+		t.Errorf("incomplete git info: %+v", info)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":       "maxFileSize = 32\n",
+		"content/big.md":   strings.Repeat("Too big. ", 10) + "\n",
+		"content/small.md": "Small.\n",
+	})
+
+	readTestFile(t, "public/small.html")
+	if _, err := os.Stat(filepath.Join("public", "big.html")); err == nil {
+		t.Error("big.md was built despite maxFileSize")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var buf bytes.Buffer
+	progress := &HenryProgress{Out: &buf, Label: "rendered", Total: 250}
+
+	if err := runHenryJobs(250, 4, func(i int) error {
+		progress.Increment()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(buf.String(), "\rrendered 250/250\n") {
+		t.Errorf("final progress line: %q", buf.String()[strings.LastIndex(buf.String(), "\r"):])
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":         "fileMode = \"0600\"\ndirMode = \"0700\"\n",
+		"content/posts/a.md": "A.\n",
+	})
+
+	for name, want := range map[string]os.FileMode{"public/posts/a.html": 0600, "public/posts": 0700 | os.ModeDir} {
+		info, err := os.Stat(filepath.FromSlash(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %s, want %s", name, info.Mode(), want)
+		}
+	}
+}
+
+func TestMetaDescription(t *testing.T) {
+	if got := henryMetaDescription(&HenryDocument{Description: "Explicit.", SummaryText: "Summary."}); got != "Explicit." {
+		t.Errorf("explicit: got %q", got)
+	}
+	if got := henryMetaDescription(&HenryDocument{SummaryText: "Summary."}); got != "Summary." {
+		t.Errorf("summary fallback: got %q", got)
+	}
+
+	long := henryMetaDescription(&HenryDocument{SummaryText: strings.Repeat("word ", 100)})
+	if n := len([]rune(long)); n > 160 || !strings.HasSuffix(long, "…") {
+		t.Errorf("truncated to %d runes: %q", n, long)
+	}
+}
+
+func TestFrontmatterDelimiters(t *testing.T) {
+	config := testConfig(t)
+	config.FrontmatterDelimiter = "==="
+
+	custom := &HenryFile{Name: "custom.md", Data: []byte("===\ntitle = \"Custom\"\n===\nBody.\n")}
+	if err := readHenryFileMetadata(custom, config); err != nil {
+		t.Fatal(err)
+	}
+	if custom.Metadata.Title != "Custom" || custom.Body != "Body.\n" {
+		t.Errorf("custom delimiter: title %q, body %q", custom.Metadata.Title, custom.Body)
+	}
+
+	unclosed := &HenryFile{Name: "unclosed.md", Data: []byte("---\ntitle: Unclosed\n\nBody.\n")}
+	if err := readHenryFileMetadata(unclosed, config); err != nil {
+		t.Fatal(err)
+	}
+	if unclosed.Metadata.Title != "Unclosed" || unclosed.Body != "Body.\n" {
+		t.Errorf("unclosed fence: title %q, body %q", unclosed.Metadata.Title, unclosed.Body)
+	}
+
+	broken := &HenryFile{Name: "broken.md", Data: []byte("---\ntitle: Broken")}
+	if err := readHenryFileMetadata(broken, config); err == nil {
+		t.Error("expected an error for a fence with no end")
+	}
+}
+
+func TestSortTies(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []string{"a/x.md", "b/x.md", "b/y.md", "c.md"}
+
+	orders := [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}}
+	for _, order := range orders {
+		all := []*HenryDocument{
+			{SubPath: "a", Name: "x.md", Title: "Same", Date: date},
+			{SubPath: "b", Name: "x.md", Title: "Same", Date: date},
+			{SubPath: "b", Name: "y.md", Title: "Same", Date: date},
+			{SubPath: "", Name: "c.md", Title: "Tie", Date: date},
+		}
+		docs := make([]*HenryDocument, 0, len(all))
+		for _, i := range order {
+			docs = append(docs, all[i])
+		}
+
+		sortHenryDocuments(docs, "date")
+
+		got := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			got = append(got, path.Join(doc.SubPath, doc.Name))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("input order %v: got %q, want %q", order, got, want)
+		}
+	}
+}
+
+func TestContentLinksAndImages(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":              "prettyURLs = true\n",
+		"content/posts/a.md":      "See https://example.com/x for more.\n\n![Alt](./img.png)\n",
+		"content/posts/img.png":   "png",
+		"content/posts/notes.txt": "not referenced",
+	})
+
+	page := readTestFile(t, "public/posts/a/index.html")
+	if !strings.Contains(page, `<a href="https://example.com/x"`) {
+		t.Errorf("bare URL was not linked: %q", page)
+	}
+	if !strings.Contains(page, `src="/posts/img.png"`) {
+		t.Errorf("relative image was not resolved: %q", page)
+	}
+	if got := readTestFile(t, "public/posts/img.png"); got != "png" {
+		t.Errorf("referenced image was not copied: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join("public", "posts", "notes.txt")); err == nil {
+		t.Error("unreferenced content file was copied")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":   "manifest = \"json\"\n",
+		"content/a.md": "A.\n",
+		"static/a.css": "body {}\n",
+	})
+
+	var entries []HenryManifestEntry
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/manifest.json")), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	written := readTestTree(t, "public")
+	delete(written, "manifest.json")
+	if len(entries) != len(written) {
+		t.Errorf("manifest has %d entries, %d files were written", len(entries), len(written))
+	}
+	for _, entry := range entries {
+		data, ok := written[entry.Path]
+		if !ok {
+			t.Errorf("manifest lists unwritten %s", entry.Path)
+			continue
+		}
+		sum := sha256.Sum256([]byte(data))
+		if entry.SHA256 != hex.EncodeToString(sum[:]) || entry.Size != int64(len(data)) {
+			t.Errorf("%s: manifest %+v does not match the file", entry.Path, entry)
+		}
+	}
+}
+
+func TestSectionIndex(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html":     "{{ safeHTML .Page.Content }}|{{ range .Site.Documents }}{{ .Name }} {{ end }}",
+		"content/posts/_index.md": "---\ntitle: Posts\n---\nAll the posts.\n",
+		"content/posts/a.md":      "A.\n",
+	})
+
+	got := readTestFile(t, "public/posts/index.html")
+	if want := "<p>All the posts.</p>|a.md "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSmartypants(t *testing.T) {
+	source := "He said \"hi\" -- twice, not `a -- b`.\n"
+
+	content, err := RenderMarkdown(source, RenderOptions{Renderer: &HenryBlackfridayRenderer{Smartypants: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"“hi”", "–", "<code>a -- b</code>"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("smartypants: %q not in %q", want, content)
+		}
+	}
+
+	content, err = RenderMarkdown(source, RenderOptions{Renderer: &HenryBlackfridayRenderer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(content, "“") || strings.Contains(content, "–") {
+		t.Errorf("smartypants off: %q", content)
+	}
+}
+
+func TestExcludeParams(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "excludeParams = [\"secret\"]\n",
+		"templates/page.html": "{{ .Page.Params.secret }}",
+		"content/a.md":        "---\noutputs: [html, json]\nparams:\n  secret: hidden\n  color: blue\n---\nA.\n",
+	})
+
+	var doc HenryDocumentJSON
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/a.json")), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Params["secret"]; ok {
+		t.Errorf("secret is in the JSON output: %v", doc.Params)
+	}
+	if doc.Params["color"] != "blue" {
+		t.Errorf("color is missing from the JSON output: %v", doc.Params)
+	}
+	if got := readTestFile(t, "public/a.html"); got != "hidden" {
+		t.Errorf("secret is not in Page.Params: %q", got)
+	}
+}
+
+func TestCPUProfile(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/a.md": "A.\n",
+	}, "-cpuprofile", "cpu.pprof")
+
+	in, err := os.Open("cpu.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	profile, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("profile is not gzip-compressed: %s", err)
+	}
+	data, err := ioutil.ReadAll(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		t.Error("profile is empty")
+	}
+}
+
+func TestMergeSourceDirs(t *testing.T) {
+	var pic bytes.Buffer
+	if err := png.Encode(&pic, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":         "lazyImages = true\n",
+		"base/posts/a.md":    "Base A.\n",
+		"base/posts/b.md":    "Base B.\n\n![](pic.png)\n",
+		"base/posts/pic.png": pic.String(),
+		"local/posts/a.md":   "Local A.\n",
+	}, "-src", "./base", "-src", "local/")
+
+	if got := readTestFile(t, "public/posts/a.html"); !strings.Contains(got, "Local A.") {
+		t.Errorf("later source did not override: %q", got)
+	}
+	got := readTestFile(t, "public/posts/b.html")
+	if !strings.Contains(got, "Base B.") {
+		t.Errorf("earlier source document is missing: %q", got)
+	}
+	if !strings.Contains(got, `width="3"`) || !strings.Contains(got, `height="2"`) {
+		t.Errorf("image size was not read from the source root: %q", got)
+	}
+	for _, name := range []string{"public/base", "public/local"} {
+		if _, err := os.Stat(filepath.FromSlash(name)); err == nil {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestPrivateWithDrafts(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/public.md":  "Public.\n",
+		"content/draft.md":   "---\ndraft: true\n---\nDraft.\n",
+		"content/private.md": "---\nprivate: true\n---\nPrivate.\n",
+	}, "-drafts")
+
+	readTestFile(t, "public/public.html")
+	readTestFile(t, "public/draft.html")
+	if _, err := os.Stat(filepath.Join("public", "private.html")); err == nil {
+		t.Error("private document was built with -drafts")
+	}
+}
+
+func TestLastModPrecedence(t *testing.T) {
+	frontmatter := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	git := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	modified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		file *HenryFile
+		want time.Time
+	}{
+		{"frontmatter", &HenryFile{Metadata: &HenryFileMetadata{LastMod: frontmatter}, GitInfo: &HenryGitInfo{Date: git}, Date: modified}, frontmatter},
+		{"git", &HenryFile{Metadata: &HenryFileMetadata{}, GitInfo: &HenryGitInfo{Date: git}, Date: modified}, git},
+		{"modtime", &HenryFile{Metadata: &HenryFileMetadata{}, Date: modified}, modified},
+	}
+
+	for _, test := range tests {
+		if got := henryLastMod(test.file); !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDraftBanner(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/draft.md":     "---\ndraft: true\n---\nDraft.\n",
+		"content/published.md": "Published.\n",
+	}, "-drafts", "-draft-banner")
+
+	if got := readTestFile(t, "public/draft.html"); !strings.Contains(got, henryDraftBanner) {
+		t.Errorf("draft has no banner: %q", got)
+	}
+	if got := readTestFile(t, "public/published.html"); strings.Contains(got, henryDraftBanner) {
+		t.Errorf("published page has a banner: %q", got)
+	}
+}
+
+func TestMarkdownEngines(t *testing.T) {
+	source := "# Title\n\nSome *text*.\n"
+	for _, renderer := range []MarkdownRenderer{&HenryBlackfridayRenderer{}, &HenryGoldmarkRenderer{}} {
+		content, err := RenderMarkdown(source, RenderOptions{Renderer: renderer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(content, "<h1") || !strings.Contains(content, "<em>text</em>") {
+			t.Errorf("%T: %q", renderer, content)
+		}
+	}
+
+	// An indented paragraph after a list item belongs to that item in
+	// CommonMark; blackfriday ends the list before it.
+	want := map[MarkdownRenderer]string{
+		&HenryBlackfridayRenderer{}: "<ul>\n<li>a</li>\n</ul>\n<p>b</p>",
+		&HenryGoldmarkRenderer{}:    "<ul>\n<li>\n<p>a</p>\n<p>b</p>\n</li>\n</ul>",
+	}
+	for renderer, want := range want {
+		content, err := RenderMarkdown("- a\n\n  b\n", RenderOptions{Renderer: renderer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != want {
+			t.Errorf("%T: got %q, want %q", renderer, content, want)
+		}
+	}
+}
+
+func TestArchiveGroups(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	docs := []*HenryDocument{
+		{Name: "a.md", Date: date(2020, time.March, 1)},
+		{Name: "b.md", Date: date(2021, time.January, 5)},
+		{Name: "c.md", Date: date(2020, time.March, 20)},
+		{Name: "d.md", Date: date(2020, time.July, 4)},
+	}
+
+	got := make([]string, 0)
+	for _, year := range groupHenryDocumentsByMonth(docs, date(2022, time.January, 1)) {
+		for _, month := range year.Months {
+			names := make([]string, 0, len(month.Documents))
+			for _, doc := range month.Documents {
+				names = append(names, doc.Name)
+			}
+			got = append(got, fmt.Sprintf("%d-%02d %s", year.Year, month.Month, strings.Join(names, ",")))
+		}
+	}
+
+	want := []string{"2021-01 b.md", "2020-07 d.md", "2020-03 c.md,a.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Title }}|{{ safeHTML .Page.Content }}",
+		"content/a.md":        "---\r\ntitle: Windows\r\n---\r\nLine one\r\nline two.\r\n\r\nNext.\r\n",
+	})
+
+	got := readTestFile(t, "public/a.html")
+	if want := "Windows|<p>Line one\nline two.</p>\n<p>Next.</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":   "manifest = \"json\"\n",
+		"content/a.md": "A.\n",
+	})
+
+	out, err := os.Create("timings.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = out
+	err = run([]string{"-quiet", "-timings"})
+	os.Stdout = stdout
+	out.Close()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	phases := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(readTestFile(t, "timings.txt")), "\n") {
+		phases = append(phases, strings.Fields(line)[0])
+	}
+	want := []string{"walk", "read", "frontmatter", "render", "write", "indexes", "static", "manifest"}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("got phases %q, want %q", phases, want)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/both.md":    "---\noutputs: [html, json]\n---\nBoth.\n",
+		"content/default.md": "Default.\n",
+	})
+
+	readTestFile(t, "public/both.html")
+	var doc HenryDocumentJSON
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/both.json")), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content != "<p>Both.</p>" {
+		t.Errorf("json content: %q", doc.Content)
+	}
+
+	readTestFile(t, "public/default.html")
+	if _, err := os.Stat(filepath.Join("public", "default.json")); err == nil {
+		t.Error("default document has a JSON output")
+	}
+}
+
+func TestFirstParagraphs(t *testing.T) {
+	doc := &HenryDocument{ContentParagraphs: []string{"<p>a</p>", "<p>b</p>", "<p>c</p>"}}
+
+	if got, want := doc.FirstParagraphs(2), []string{"<p>a</p>", "<p>b</p>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("n within range: got %q, want %q", got, want)
+	}
+	if got := doc.FirstParagraphs(10); !reflect.DeepEqual(got, doc.ContentParagraphs) {
+		t.Errorf("n past the end: got %q", got)
+	}
+	if got := doc.FirstParagraphs(0); len(got) != 0 {
+		t.Errorf("n zero: got %q", got)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":     "redirectPages = true\n",
+		"redirects.toml": "[[redirect]]\nfrom = \"/old/\"\nto = \"/new.html\"\n\n[[redirect]]\nfrom = \"/gone\"\nto = \"https://example.com/\"\nstatus = 302\n",
+		"content/new.md": "New.\n",
+	})
+
+	if got, want := readTestFile(t, "public/_redirects"), "/old/ /new.html 301\n/gone https://example.com/ 302\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := readTestFile(t, "public/old/index.html"); !strings.Contains(got, `url=/new.html`) {
+		t.Errorf("redirect page: %q", got)
+	}
+
+	writeTestSite(t, map[string]string{
+		"henry.toml":     "redirectPages = true\n",
+		"redirects.toml": "[[redirect]]\nfrom = \"/../../escape\"\nto = \"/new.html\"\n",
+		"content/new.md": "New.\n",
+	})
+	if err := run([]string{"-quiet"}); err == nil || !strings.Contains(err.Error(), "outside the output directory") {
+		t.Errorf("run returned %v, want an error for a redirect outside the output directory", err)
+	}
+}
+
+func TestProtectCode(t *testing.T) {
+	content, err := RenderMarkdown("```html\n<script>alert(1)</script>\n```\n\n<script>alert(2)</script>\n", RenderOptions{ProtectCode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(content, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("fenced script was not kept as escaped text: %q", content)
+	}
+	if strings.Contains(content, "<script>") || strings.Contains(content, "alert(2)") {
+		t.Errorf("raw script survived sanitizing: %q", content)
+	}
+}
+
+func TestUglyURLs(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "uglyURLs = true\nprettyURLs = true\n",
+		"templates/page.html": "{{ range .Site.Documents }}{{ .URL }} {{ end }}",
+		"content/about.md":    "About.\n",
+		"content/posts/a.md":  "A.\n",
+	})
+
+	if got, want := readTestFile(t, "public/about.html"), "/about.html /posts/a.html "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	readTestFile(t, "public/posts/a.html")
+}
+
+func TestIncludes(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":           "publishIncludes = false\n",
+		"content/page.md":      "---\ninclude: [parts/one.md, parts/two.md]\n---\nIntro.\n",
+		"content/parts/one.md": "One.\n",
+		"content/parts/two.md": "Two.\n",
+		"content/cycle/a.md":   "---\ninclude: [b.md]\n---\nA.\n",
+		"content/cycle/b.md":   "---\ninclude: [a.md]\n---\nB.\n",
+	})
+
+	if got, want := readTestFile(t, "public/page.html"), "<p>Intro.</p>\n<p>One.</p>\n<p>Two.</p>"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join("public", "parts", "one.html")); err == nil {
+		t.Error("included fragment was published")
+	}
+
+	config := testConfig(t)
+	file := &HenryFile{Name: "a.md", Path: filepath.Join("content", "cycle", "a.md")}
+	if err := readHenryFileData(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := readHenryFileMetadata(file, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expandHenryIncludes(file, config, nil); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("got %v, want an include cycle error", err)
+	}
+}
+
+func TestSlugs(t *testing.T) {
+	config := &HenryConfig{Slug: HenrySlugConfig{Transliterate: map[string]string{"++": "pp", "#": "sharp"}}}
+
+	cpp, csharp := slugifyHenry("C++", config), slugifyHenry("C#", config)
+	if cpp != "cpp" || csharp != "csharp" {
+		t.Errorf("transliterate: got %q and %q", cpp, csharp)
+	}
+
+	config = &HenryConfig{Slug: HenrySlugConfig{Replace: map[string]string{"C++": "cplusplus"}, Preserve: "#"}}
+	cpp, csharp = slugifyHenry("c++", config), slugifyHenry("C#", config)
+	if cpp != "cplusplus" || csharp != "c#" {
+		t.Errorf("replace and preserve: got %q and %q", cpp, csharp)
+	}
+
+	if got := slugifyHenry("C++", &HenryConfig{}); got != "c" {
+		t.Errorf("default: got %q, want %q", got, "c")
+	}
+}
+
+func TestTemplateSyntaxError(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Title ",
+		"content/a.md":        "A.\n",
+	})
+
+	err := run([]string{"-quiet"})
+	if err == nil || !strings.Contains(err.Error(), "error parsing templates in 'templates'") {
+		t.Errorf("run returned %v, want a template parse error", err)
+	}
+	if _, err := os.Stat(filepath.Join("public", "a.html")); err == nil {
+		t.Error("a document was rendered before the template error")
+	}
+}
+
+func TestSiteStats(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Site.Stats.Published }} {{ .Site.Stats.Drafts }} {{ index .Site.Stats.Tags \"go\" }} {{ index .Site.Stats.Years 2020 }}",
+		"content/a.md":        "---\ndate: 2020-01-01\ntags: [go]\n---\nA.\n",
+		"content/b.md":        "---\ndate: 2020-06-01\ntags: [go, web]\n---\nB.\n",
+		"content/c.md":        "---\ndate: 2021-01-01\n---\nC.\n",
+		"content/d.md":        "---\ndraft: true\ntags: [go]\n---\nD.\n",
+	})
+
+	if got, want := readTestFile(t, "public/a.html"), "3 1 2 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEmbeddedTemplates(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":   "title = \"Site\"\n",
+		"content/a.md": "---\ntitle: Hello\n---\nBody.\n",
+	})
+
+	got := readTestFile(t, "public/a.html")
+	for _, want := range []string{"<!doctype html>", "<title>Hello - Site</title>", "<h1>Hello</h1>", "<p>Body.</p>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not in %q", want, got)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":      "language = \"en\"\n",
+		"content/de.md":   "---\nlang: de\n---\nHallo.\n",
+		"content/site.md": "Hello.\n",
+	})
+
+	if got := readTestFile(t, "public/de.html"); !strings.Contains(got, `<html lang="de">`) {
+		t.Errorf("de.html: %q", got)
+	}
+	if got := readTestFile(t, "public/site.html"); !strings.Contains(got, `<html lang="en">`) {
+		t.Errorf("site.html: %q", got)
+	}
+}
+
+func TestNormalizeHTML(t *testing.T) {
+	input := []byte(`<!doctype html><html><head><title>T</title></head><body><div b="2" a="1"><p>One</p><p>Two <em>x</em></p></div><pre>  keep
+  this</pre></body></html>`)
+
+	first, err := normalizeHenryHTML(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		again, err := normalizeHenryHTML(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, again) {
+			t.Fatalf("run %d differs:\n%s\n%s", i, first, again)
+		}
+	}
+
+	stable, err := normalizeHenryHTML(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, stable) {
+		t.Errorf("normalizing twice changed the output:\n%s\n%s", first, stable)
+	}
+	for _, want := range []string{`<div a="1" b="2">`, "<pre>  keep\n  this</pre>"} {
+		if !strings.Contains(string(first), want) {
+			t.Errorf("%q not in %q", want, first)
+		}
+	}
+}
+
+func TestScheduled(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	docs := []*HenryDocument{
+		{Name: "past.md", Date: now.AddDate(0, -1, 0)},
+		{Name: "later.md", Date: now.AddDate(0, 2, 0)},
+		{Name: "soon.md", Date: now.AddDate(0, 0, 3)},
+		{Name: "draft.md", Date: now.AddDate(0, 1, 0), Draft: true},
+	}
+
+	names := make([]string, 0)
+	for _, doc := range scheduledHenryDocuments(docs, now, false) {
+		names = append(names, doc.Name)
+	}
+	if want := []string{"soon.md", "later.md"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
+
+func TestListScheduled(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":   "preBuild = \"touch hooked\"\n",
+		"content/a.md": "A.\n",
+		"content/b.md": "---\ndate: 2999-01-02T03:04:00Z\n---\nLater.\n",
+	})
+
+	stdout := os.Stdout
+	out, err := os.Create("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = out
+	err = run([]string{"-quiet", "-hooks", "-list-scheduled"})
+	os.Stdout = stdout
+	out.Close()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if got, want := readTestFile(t, "out.txt"), "2999-01-02 03:04 b.html\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, name := range []string{"public", "hooked"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestRenderDocumentHTML(t *testing.T) {
+	tmpl := template.Must(template.New("").Funcs(henryTemplateFuncs).Parse(`{{ define "page.html" }}<h1>{{ .Page.Title }}</h1>{{ safeHTML .Page.Content }}{{ end }}`))
+	doc := &HenryDocument{Path: "a.html", Title: "A & B", Content: "<p>Body.</p>"}
+
+	got, err := RenderDocumentHTML(doc, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<h1>A &amp; B</h1><p>Body.</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := RenderDocumentHTML(doc, template.Must(template.New("other.html").Parse("x"))); err == nil {
+		t.Error("expected an error without page.html")
+	}
+}
+
+func TestSummaryPrecedence(t *testing.T) {
+	tests := []struct {
+		name        string
+		frontmatter string
+		feed        string
+		meta        string
+	}{
+		{"summary", "summary: From *summary*.\ndescription: From description.\n", "From summary.", "From description."},
+		{"description", "description: From description.\n", "From description.", "From description."},
+		{"paragraph", "title: Neither\n", "First paragraph.", "First paragraph."},
+		{"summary only", "summary: From summary.\n", "From summary.", "From summary."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buildTestSite(t, map[string]string{
+				"templates/page.html": "{{ .Page.FeedSummary }}|{{ .Page.MetaDescription }}",
+				"content/a.md":        "---\n" + test.frontmatter + "---\nFirst paragraph.\n\nSecond.\n",
+			})
+
+			if got, want := readTestFile(t, "public/a.html"), test.feed+"|"+test.meta; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEmptyFrontmatter(t *testing.T) {
+	config := testConfig(t)
+
+	for _, data := range []string{"---\n---\n# Body\n", "+++\n\n+++\n# Body\n"} {
+		file := &HenryFile{Name: "a.md", Data: []byte(data)}
+		if err := readHenryFileMetadata(file, config); err != nil {
+			t.Errorf("%q: %s", data, err)
+			continue
+		}
+		if file.Body != "# Body\n" || file.Metadata.Title != "" {
+			t.Errorf("%q: body %q, title %q", data, file.Body, file.Metadata.Title)
+		}
+	}
+}
+
+func TestGemtext(t *testing.T) {
+	got := renderHenryGemtext("# Title\n\nSee [the docs](https://example.com/docs) now.\n")
+
+	want := "# Title\n\nSee the docs now.\n=> https://example.com/docs the docs\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEnvironmentRestriction(t *testing.T) {
+	files := map[string]string{
+		"content/a.md":       "A.\n",
+		"content/staging.md": "---\nenvironments: [staging]\n---\nStaging only.\n",
+	}
+
+	buildTestSite(t, files)
+	readTestFile(t, "public/a.html")
+	if _, err := os.Stat(filepath.Join("public", "staging.html")); err == nil {
+		t.Error("staging document was built for production")
+	}
+
+	buildTestSite(t, files, "-env", "staging")
+	readTestFile(t, "public/staging.html")
+}
+
+func TestSiteParams(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "[params]\ntwitter = \"@me\"\n",
+		"templates/page.html": "{{ .Site.Params.twitter }}",
+		"content/a.md":        "A.\n",
+	})
+
+	if got := readTestFile(t, "public/a.html"); got != "@me" {
+		t.Errorf("got %q, want %q", got, "@me")
+	}
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	content, err := RenderMarkdown("# Intro\n\n## Intro\n\n### Other *one*\n", RenderOptions{HeadingAnchors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`<h1 id="intro">Intro <a href="#intro" class="anchor">#</a></h1>`,
+		`<h2 id="intro-1">Intro <a href="#intro-1" class="anchor">#</a></h2>`,
+		`<h3 id="other-one">Other <em>one</em> <a href="#other-one" class="anchor">#</a></h3>`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("%s not in %q", want, content)
+		}
+	}
+}
+
+func TestHeadingAnchorsUseSlugConfig(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "headingAnchors = true\ntocMarker = \"[[toc]]\"\n\n[slug.transliterate]\n\"++\" = \"pp\"\n",
+		"templates/page.html": "{{ .Page.Content | safeHTML }}",
+		"content/a.md":        "[[toc]]\n\n## C++\n",
+	})
+
+	got := readTestFile(t, "public/a.html")
+	for _, want := range []string{`<a href="#cpp">C++`, `<h2 id="cpp">C++ <a href="#cpp" class="anchor">#</a></h2>`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not in %q", want, got)
+		}
+	}
+}
+
+func TestFilenameDate(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":                        "filenameDate = '^(?:(\\d{4}-\\d{2}-\\d{2})-)?'\n",
+		"templates/page.html":               "{{ .Page.Name }}|{{ .Page.Title }}|{{ .Page.Date.Format \"2006-01-02\" }}",
+		"content/posts/2023-05-01-hello.md": "Hello.\n",
+		"content/posts/undated.md":          "Undated.\n",
+	})
+
+	if got, want := readTestFile(t, "public/posts/hello.html"), "2023-05-01-hello.md|Hello|2023-05-01"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	readTestFile(t, "public/posts/undated.html")
+}
+
+func TestFilenameDateCollision(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":                  "filenameDate = '^(\\d{4}-\\d{2}-\\d{2})-'\n",
+		"content/2023-05-01-hello.md": "One.\n",
+		"content/2024-01-01-hello.md": "Two.\n",
+	})
+
+	err := run([]string{"-quiet"})
+	if err == nil || !strings.Contains(err.Error(), "both write 'hello.html'") {
+		t.Errorf("run returned %v, want a collision error", err)
+	}
+}
+
+func TestTitleFromHeading(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		source string
+		want   string
+	}{
+		{"extract", "titleFromHeading = true\n", "# From Heading\n\nBody.\n", "From Heading|<h1>From Heading</h1>\n<p>Body.</p>"},
+		{"strip", "titleFromHeading = true\nstripTitleHeading = true\n", "# From Heading\n\nBody.\n", "From Heading|<p>Body.</p>"},
+		{"fallback", "titleFromHeading = true\n", "## Not a title\n\nBody.\n", "My Post|<h2>Not a title</h2>\n<p>Body.</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buildTestSite(t, map[string]string{
+				"henry.toml":          test.config,
+				"templates/page.html": "{{ .Page.Title }}|{{ safeHTML .Page.Content }}",
+				"content/my-post.md":  test.source,
+			})
+
+			if got := strings.TrimSpace(readTestFile(t, "public/my-post.html")); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTeaser(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Teaser }}",
+		"content/explicit.md": "---\nteaser: Short and sweet.\n---\n" + long + "\n",
+		"content/auto.md":     long + "\n",
+	})
+
+	if got := readTestFile(t, "public/explicit.html"); got != "Short and sweet." {
+		t.Errorf("explicit teaser: got %q", got)
+	}
+	got := readTestFile(t, "public/auto.html")
+	if n := len([]rune(got)); n > 100 || !strings.HasSuffix(got, "…") || !strings.HasPrefix(got, "word word") {
+		t.Errorf("auto teaser of %d runes: %q", n, got)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run through sh")
+	}
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":   "preBuild = \"echo pre > pre.txt\"\npostBuild = \"test -f public/a.html && echo post > post.txt\"\n",
+		"content/a.md": "A.\n",
+	}, "-hooks")
+	for _, name := range []string{"pre.txt", "post.txt"} {
+		readTestFile(t, name)
+	}
+
+	writeTestSite(t, map[string]string{
+		"henry.toml":   "postBuild = \"exit 3\"\n",
+		"content/a.md": "A.\n",
+	})
+	err := run([]string{"-quiet", "-hooks"})
+	if err == nil || !strings.Contains(err.Error(), "error running postBuild hook") {
+		t.Errorf("run returned %v, want a hook error", err)
+	}
+}
+
+func TestRemoteSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/markdown")
+		io.WriteString(w, "---\ntitle: Remote\n---\nFetched *over* HTTP.\n")
+	}))
+	defer server.Close()
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":          fmt.Sprintf("[[remote]]\nurl = %q\npath = \"docs/remote.md\"\n", server.URL+"/remote.md"),
+		"templates/page.html": "{{ .Page.Title }}|{{ safeHTML .Page.Content }}",
+		"content/a.md":        "A.\n",
+	})
+
+	if got, want := readTestFile(t, "public/docs/remote.html"), "Remote|<p>Fetched <em>over</em> HTTP.</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":      "baseURL = \"https://example.com\"\nskipEmpty = true\nsitemap = true\njsonFeed = true\ntagFeeds = true\n",
+		"content/full.md": "---\ntags: [go]\n---\nBody.\n",
+		"content/bare.md": "---\ntitle: Bare\ntags: [go]\n---\n",
+	})
+
+	readTestFile(t, "public/full.html")
+	if _, err := os.Stat(filepath.Join("public", "bare.html")); err == nil {
+		t.Error("body-less document was written")
+	}
+	for _, name := range []string{"public/sitemap.xml", "public/feed.json", "public/tags/go/rss.xml"} {
+		if got := readTestFile(t, name); strings.Contains(got, "bare.html") || !strings.Contains(got, "full.html") {
+			t.Errorf("%s: %q", name, got)
+		}
+	}
+	if got := readTestFile(t, "public/tags/go/index.json"); !strings.Contains(got, "bare.html") {
+		t.Errorf("tag index does not list the body-less document: %q", got)
+	}
+}
+
+func TestFileTypes(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":        "[types]\n\".org\" = \"plain\"\n\".bak\" = \"ignore\"\n",
+		"content/notes.org": "* Heading <b>\n",
+		"content/old.bak":   "# Backup\n",
+	})
+
+	if got := readTestFile(t, "public/notes.html"); !strings.Contains(got, "<pre>* Heading &lt;b&gt;\n</pre>") {
+		t.Errorf("notes.org was not rendered as plain text: %q", got)
+	}
+	for _, name := range []string{"public/old.html", "public/old.bak"} {
+		if _, err := os.Stat(filepath.FromSlash(name)); err == nil {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestFingerprintURLs(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "baseURL = \"https://example.com\"\nfingerprintURLs = true\nsitemap = true\n",
+		"templates/page.html": "{{ range .Site.Documents }}{{ .LinkURL }}{{ end }}",
+		"content/a.md":        "A.\n",
+	})
+
+	if got := readTestFile(t, "public/a.html"); !regexp.MustCompile(`^/a\.html\?v=[0-9a-f]{12}$`).MatchString(got) {
+		t.Errorf("listing link has no version: %q", got)
+	}
+	if got := readTestFile(t, "public/sitemap.xml"); strings.Contains(got, "?v=") || !strings.Contains(got, "https://example.com/a.html") {
+		t.Errorf("sitemap: %q", got)
+	}
+}
+
+func TestArchiveOutput(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/a.md":       "A.\n",
+		"content/posts/b.md": "B.\n",
+		"static/style.css":   "body {}\n",
+	}, "-archive", "site.zip")
+
+	zr, err := zip.OpenReader("site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	names := make([]string, 0, len(zr.File))
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+
+	want := []string{"a.html", "posts/b.html", "style.css", "tags/index.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
+
+type testTagPrefixer struct{}
+
+func (p *testTagPrefixer) Transform(metadata *HenryFileMetadata) {
+	for i, tag := range metadata.Tags {
+		metadata.Tags[i] = "x-" + tag
+	}
+}
+
+func TestMetadataTransformer(t *testing.T) {
+	RegisterMetadataTransformer("test-prefix", &testTagPrefixer{})
+	defer delete(henryMetadataTransformers, "test-prefix")
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "transform = [\"lowercase-tags\", \"test-prefix\"]\n",
+		"templates/page.html": "{{ range .Page.Tags }}{{ . }} {{ end }}",
+		"content/a.md":        "---\ntags: [Go, Web]\n---\nA.\n",
+	})
+
+	if got, want := readTestFile(t, "public/a.html"), "x-go x-web "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestImplausibleYear(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"content/typo.md": "---\ndate: 0023-05-01\n---\nTypo.\n",
+		"content/fine.md": "---\ndate: 2023-05-01\n---\nFine.\n",
+	})
+
+	if err := run([]string{"-log-file", "build.log"}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	log := readTestFile(t, "build.log")
+	if !strings.Contains(log, "warning: error parsing date in 'typo.md': year 23 is before minYear 1990") {
+		t.Errorf("no warning for year 23: %q", log)
+	}
+	if strings.Contains(log, "fine.md") {
+		t.Errorf("warning for a plausible date: %q", log)
+	}
+
+	err := run([]string{"-quiet", "-strict"})
+	if _, ok := err.(*HenryStrictError); !ok {
+		t.Errorf("strict build returned %v, want a HenryStrictError", err)
+	}
+}
+
+func TestJSONFeed(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":       "baseURL = \"https://example.com\"\njsonFeed = true\n",
+		"content/a.md":     "---\ndate: 2020-01-01\ndescription: About A.\n---\nFirst paragraph of A.\n",
+		"content/b.md":     "---\ndate: 2020-01-02\n---\nFirst paragraph of B.\n",
+		"content/c.md":     "---\ndate: 2020-01-03\nexclude: [feed]\n---\nC.\n",
+		"content/draft.md": "---\ndraft: true\n---\nDraft.\n",
+	})
+
+	var feed HenryJSONFeed
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/feed.json")), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if feed.Version != "https://jsonfeed.org/version/1.1" {
+		t.Errorf("version = %q", feed.Version)
+	}
+	if len(feed.Items) != 2 {
+		t.Fatalf("got %d items, want 2", len(feed.Items))
+	}
+	if feed.Items[0].Summary != "First paragraph of B." || feed.Items[1].Summary != "About A." {
+		t.Errorf("summaries %q and %q", feed.Items[0].Summary, feed.Items[1].Summary)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"henry.toml":   "progressThreshold = 0\n",
+		"content/a.md": "A.\n",
+		"content/b.md": "---\ndate: 2999-01-01\n---\nScheduled.\n",
+	})
+
+	stdout, stderr := os.Stdout, os.Stderr
+	out, err := os.Create("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, os.Stderr = out, out
+	err = run([]string{"-quiet"})
+	os.Stdout, os.Stderr = stdout, stderr
+	out.Close()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if got := readTestFile(t, "out.txt"); got != "" {
+		t.Errorf("-quiet printed %q", got)
+	}
+}
+
+func TestNoDraftsAllowed(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"content/a.md": "A.\n",
+	}, "-no-drafts-allowed")
+
+	writeTestSite(t, map[string]string{
+		"content/a.md":     "A.\n",
+		"content/draft.md": "---\ndraft: true\n---\nDraft.\n",
+	})
+	err := run([]string{"-quiet", "-no-drafts-allowed"})
+	if _, ok := err.(*HenryStrictError); !ok || !strings.Contains(err.Error(), "draft.md") {
+		t.Errorf("run returned %v, want a HenryStrictError naming draft.md", err)
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":            "[[generators]]\ntemplate = \"member.html\"\ndata = \"team.members\"\npath = \"team/{name}/index.html\"\n",
+		"data/team.toml":        "[[members]]\nname = \"Ada Lovelace\"\n\n[[members]]\nname = \"Alan Turing\"\n\n[[members]]\nname = \"Grace Hopper\"\n",
+		"templates/page.html":   "{{ .Page.Title }}",
+		"templates/member.html": "{{ .Record.name }}",
+		"content/a.md":          "A.\n",
+	})
+
+	for slug, name := range map[string]string{"ada-lovelace": "Ada Lovelace", "alan-turing": "Alan Turing", "grace-hopper": "Grace Hopper"} {
+		if got := readTestFile(t, "public/team/"+slug+"/index.html"); got != name {
+			t.Errorf("%s: got %q, want %q", slug, got, name)
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join("public", "team"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d generated pages, want 3", len(entries))
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	writeTestSite(t, map[string]string{
+		"content/a.md": "A.\n",
+	})
+
+	stdout := os.Stdout
+	out, err := os.Create("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = out
+	err = run([]string{"-log-file", "build.log"})
+	os.Stdout = stdout
+	out.Close()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if got := readTestFile(t, "out.txt"); got != "" {
+		t.Errorf("stdout: %q", got)
+	}
+	if log := readTestFile(t, "build.log"); !strings.Contains(log, "built 1 documents, wrote 2 files to public") {
+		t.Errorf("log: %q", log)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ safeHTML .Page.Content }}",
+		"content/security.md": "---\noutputPath: .well-known/security.txt\n---\nContact: mailto:security@example.com\n",
+	})
+
+	if got := readTestFile(t, "public/.well-known/security.txt"); !strings.Contains(got, "security@example.com") {
+		t.Errorf("got %q", got)
+	}
+
+	config := testConfig(t)
+	file := &HenryFile{Name: "escape.md", Data: []byte("---\noutputPath: ../escape.html\n---\nBody.\n")}
+	if err := readHenryFileMetadata(file, config); err == nil || !strings.Contains(err.Error(), "outside the output directory") {
+		t.Errorf("got %v, want an error for ../escape.html", err)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html":       "{{ range .Page.Resources }}{{ .Name }}={{ .URL }} {{ end }}",
+		"content/my-post/index.md":  "Bundle.\n",
+		"content/my-post/cover.jpg": "jpg",
+	})
+
+	if got, want := readTestFile(t, "public/my-post/index.html"), "cover.jpg=/my-post/cover.jpg "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := readTestFile(t, "public/my-post/cover.jpg"); got != "jpg" {
+		t.Errorf("cover.jpg: %q", got)
+	}
+}
+
+func TestValidateHTML(t *testing.T) {
+	if err := validateHenryHTML([]byte("<!doctype html><html><body><p>One<p>Two<br><img src=x></body></html>")); err != nil {
+		t.Errorf("valid HTML was flagged: %s", err)
+	}
+	if err := validateHenryHTML([]byte("<div><span>unclosed</div>")); err == nil {
+		t.Error("broken HTML was not flagged")
+	}
+
+	writeTestSite(t, map[string]string{
+		"templates/page.html": "<div>{{ .Page.Title }}",
+		"content/a.md":        "A.\n",
+	})
+	err := run([]string{"-quiet", "-validate-html"})
+	if err == nil || !strings.Contains(err.Error(), "invalid html: a.html") {
+		t.Errorf("run returned %v, want a validation error", err)
+	}
+}
+
+func TestTOCMarker(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "tocMarker = \"[[toc]]\"\n",
+		"templates/page.html": "{{ .Page.Content | safeHTML }}",
+		"content/a.md":        "Intro.\n\n[[toc]]\n\n## One\n\n### One A\n\n## Two\n",
+	})
+
+	want := "<p>Intro.</p>\n" +
+		"<nav class=\"toc\"><ul><li><a href=\"#one\">One</a><ul><li><a href=\"#one-a\">One A</a></li></ul></li>" +
+		"<li><a href=\"#two\">Two</a></li></ul></nav>\n<h2 id=\"one\">One</h2>"
+	if got := readTestFile(t, "public/a.html"); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+}
+
+func TestTagFeeds(t *testing.T) {
+	for _, title := range []string{"Site", ""} {
+		buildTestSite(t, map[string]string{
+			"henry.toml":          fmt.Sprintf("title = %q\nbaseURL = \"https://example.com/blog/\"\ntagFeeds = true\n", title),
+			"templates/page.html": "{{ .Page.Title }}",
+			"content/a.md":        "---\ntitle: A\ndescription: About A.\ntags: [go]\n---\nA.\n",
+			"content/b.md":        "---\ntitle: B\ntags: [go, web]\n---\nB.\n",
+			"content/c.md":        "---\ntitle: C\ntags: [web]\n---\nC.\n",
+		})
+
+		var feed HenryRSS
+		if err := xml.Unmarshal([]byte(readTestFile(t, "public/tags/go/rss.xml")), &feed); err != nil {
+			t.Fatal(err)
+		}
+
+		wantTitle := "go"
+		if title != "" {
+			wantTitle = title + ": go"
+		}
+		if feed.Channel.Title != wantTitle {
+			t.Errorf("title = %q, want %q", feed.Channel.Title, wantTitle)
+		}
+
+		got := make(map[string]string)
+		for _, item := range feed.Channel.Items {
+			got[item.Title] = item.Description
+		}
+		if want := map[string]string{"A": "About A.", "B": "B."}; !reflect.DeepEqual(got, want) {
+			t.Errorf("items = %v, want %v", got, want)
+		}
+
+		var indexes []HenryTagIndex
+		if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/index.json")), &indexes); err != nil {
+			t.Fatal(err)
+		}
+		if len(indexes) != 2 || indexes[0].Feed != "/blog/tags/go/rss.xml" {
+			t.Errorf("indexes = %+v, want the go feed under /blog", indexes)
+		}
+	}
+}
+
+func TestLazyImages(t *testing.T) {
+	var pic bytes.Buffer
+	if err := png.Encode(&pic, image.NewRGBA(image.Rect(0, 0, 4, 5))); err != nil {
+		t.Fatal(err)
+	}
+
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "lazyImages = true\n",
+		"templates/page.html": "{{ .Page.Content | safeHTML }}",
+		"content/a.md":        "![local](pic.png)\n\n![remote](https://example.com/x.png)\n",
+		"content/pic.png":     pic.String(),
+	})
+
+	got := readTestFile(t, "public/a.html")
+	local := regexp.MustCompile(`<img[^>]*alt="local"[^>]*>`).FindString(got)
+	for _, attr := range []string{`loading="lazy"`, `width="4"`, `height="5"`} {
+		if !strings.Contains(local, attr) {
+			t.Errorf("local image %q is missing %s", local, attr)
+		}
+	}
+	remote := regexp.MustCompile(`<img[^>]*alt="remote"[^>]*>`).FindString(got)
+	if !strings.Contains(remote, `loading="lazy"`) {
+		t.Errorf("remote image %q is not lazy", remote)
+	}
+	if strings.Contains(remote, "width=") || strings.Contains(remote, "height=") {
+		t.Errorf("remote image %q has a size", remote)
+	}
+}
+
+func TestExcludeSearch(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":          "baseURL = \"https://example.com\"\nsitemap = true\njsonFeed = true\n",
+		"templates/page.html": "{{ .Page.Title }}",
+		"content/a.md":        "---\ntitle: A\ntags: [go]\n---\nA.\n",
+		"content/huge.md":     "---\ntitle: Huge\ntags: [go]\nexclude: [search]\n---\nHuge.\n",
+	})
+
+	if got := readTestFile(t, "public/huge.html"); got != "Huge" {
+		t.Errorf("huge.html = %q", got)
+	}
+	if got := readTestFile(t, "public/sitemap.xml"); !strings.Contains(got, "https://example.com/huge.html") {
+		t.Errorf("huge.html is missing from the sitemap: %q", got)
+	}
+
+	var feed HenryJSONFeed
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/feed.json")), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Items) != 2 {
+		t.Errorf("feed items = %+v, want both documents", feed.Items)
+	}
+	var entries []HenryTagEntry
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/go/index.json")), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Title != "A" {
+		t.Errorf("tag index = %+v, want only A", entries)
+	}
+
+	var indexes []HenryTagIndex
+	if err := json.Unmarshal([]byte(readTestFile(t, "public/tags/index.json")), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].Count != 2 {
+		t.Errorf("indexes = %+v, want go with a count of 2", indexes)
+	}
+}
+
+func TestExcludeUnknown(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"templates/page.html": "{{ .Page.Title }}",
+		"content/a.md":        "---\ntitle: A\nexclude: [bogus]\n---\nA.\n",
+	})
+	if got := readTestFile(t, "public/a.html"); got != "A" {
+		t.Errorf("a.html = %q, an unknown exclude must not drop the page", got)
+	}
+
+	err := run([]string{"-quiet", "-strict"})
+	if _, ok := err.(*HenryStrictError); !ok {
+		t.Errorf("strict build returned %v, want a HenryStrictError", err)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	for _, key := range []string{"HENRY_TEST_ENV_TITLE", "HENRY_TEST_ENV_SET"} {
+		key := key
+		t.Cleanup(func() { os.Unsetenv(key) })
+	}
+	os.Unsetenv("HENRY_TEST_ENV_TITLE")
+	os.Setenv("HENRY_TEST_ENV_SET", "shell")
+
+	buildTestSite(t, map[string]string{
+		".env":                "# site settings\nexport HENRY_TEST_ENV_TITLE=\"From env\"\nHENRY_TEST_ENV_SET=file # ignored\n",
+		"henry.toml":          "title = \"${HENRY_TEST_ENV_TITLE} ${HENRY_TEST_ENV_SET}\"\n",
+		"templates/page.html": "{{ .Site.Title }}",
+		"content/a.md":        "A.\n",
+	})
+
+	if got, want := readTestFile(t, "public/a.html"), "From env shell"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSitemapLimit(t *testing.T) {
+	buildTestSite(t, map[string]string{
+		"henry.toml":   "baseURL = \"https://example.com\"\nsitemap = true\nsitemapLimit = 2\n",
+		"content/a.md": "A.\n",
+		"content/b.md": "B.\n",
+		"content/c.md": "C.\n",
+	})
+
+	if _, err := os.Stat(filepath.Join("public", "sitemap.xml")); err == nil {
+		t.Error("sitemap.xml should not exist once the sitemap is split")
+	}
+
+	var index HenrySitemapIndex
+	if err := xml.Unmarshal([]byte(readTestFile(t, "public/sitemap_index.xml")), &index); err != nil {
+		t.Fatal(err)
+	}
+	want := []HenrySitemapEntry{{Loc: "https://example.com/sitemap-1.xml"}, {Loc: "https://example.com/sitemap-2.xml"}}
+	if !reflect.DeepEqual(index.Sitemaps, want) {
+		t.Errorf("index = %+v, want %+v", index.Sitemaps, want)
+	}
+
+	var locs []string
+	for i, count := range []int{2, 1} {
+		var sitemap HenrySitemap
+		if err := xml.Unmarshal([]byte(readTestFile(t, fmt.Sprintf("public/sitemap-%d.xml", i+1))), &sitemap); err != nil {
+			t.Fatal(err)
+		}
+		if len(sitemap.URLs) != count {
+			t.Errorf("sitemap-%d.xml has %d URLs, want %d", i+1, len(sitemap.URLs), count)
+		}
+		for _, url := range sitemap.URLs {
+			locs = append(locs, url.Loc)
+		}
+	}
+	if want := []string{"https://example.com/a.html", "https://example.com/b.html", "https://example.com/c.html"}; !reflect.DeepEqual(locs, want) {
+		t.Errorf("got %v, want %v", locs, want)
+	}
+}